@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPeerPoll  = 64 * time.Second   //对等体默认轮询间隔 2^6秒
+	maxPeerPoll      = 1024 * time.Second //收到RATE后轮询间隔的上限 2^10秒
+	passiveTimeout   = 8                  //被动关联连续8个轮询周期未收到报文后撤销
+	upstreamHoldover = 8                  //上游服务器连续8个轮询周期不可达后本机视为未同步
+
+	// HostModeBroadcastClient is the host mode of an association mobilized
+	// by broadcasts. Packets never carry it; ntpd uses the same value.
+	HostModeBroadcastClient uint8 = 6
+)
+
+// Association is the RFC 5905 state kept for one remote peer or server.
+type Association struct {
+	ID       uint16 //关联ID，mode 6控制报文用它指定对端
+	Addr     *net.UDPAddr
+	HostMode uint8         //本端模式：配置的对等体为主动1 对端发起的为被动2 上游服务器为客户端3 广播服务器为6
+	KeyID    uint32        //对称密钥ID，0表示不认证
+	Poll     time.Duration //轮询间隔
+
+	// 报文交换状态 RFC 5905 9.1
+	org NtpTimestamp //最近收到的对端发送时间戳，下次发送时填入Origin
+	rec NtpTimestamp //最近收到对端报文的本地时间，下次发送时填入Receive
+	xmt NtpTimestamp //最近一次发给对端的发送时间戳，用于识别伪造/过期报文
+
+	xmtClockOffset time.Duration //发送xmt时服务时间与本地时钟之差
+
+	Reach      uint8         //可达性移位寄存器，每个轮询周期左移一位，收到有效报文置最低位
+	Leap       uint8         //对端LI
+	Stratum    uint8         //对端stratum
+	RefID      uint32        //对端参考标识
+	RefTime    NtpTimestamp  //对端参考时间戳
+	Precision  int8          //对端精度 log2秒
+	RootDelay  time.Duration //对端根延迟
+	RootDisp   time.Duration //对端根离散度
+	Offset     time.Duration //对端时间 - 本地时间，取时钟滤波器中延迟最小的样本
+	Delay      time.Duration //往返延迟
+	Dispersion time.Duration //时钟滤波器给出的离散度
+	Jitter     time.Duration //时钟滤波器样本之间的抖动
+	Updated    time.Time     //最近一次有效样本的本地时间
+	Select     SelectStatus  //最近一次时钟选择的结果
+
+	filter      [filterStages]filterSample //时钟滤波器移位寄存器，最新的在前
+	filterLen   int
+	filterUsed  time.Time     //上一次选用的样本时间
+	clockOffset time.Duration //滤波后相对本地时钟(而非服务时间)的偏差
+
+	nextPoll time.Time
+	idle     int //被动关联未收到报文的轮询周期数
+}
+
+// AssociationManager owns the associations and the socket they share with
+// the server, since peers and servers talk from port 123 to port 123.
+type AssociationManager struct {
+	Service *NTPService
+	Conn    *net.UDPConn
+
+	mu        sync.Mutex
+	assocs    map[string]*Association
+	lastID    uint16
+	sysPeer   uint16        //当前同步源的关联ID，0表示没有
+	sysJitter time.Duration //参与合成的源之间的抖动
+}
+
+// NewAssociationManager returns a manager sending on conn.
+func NewAssociationManager(service *NTPService, conn *net.UDPConn) *AssociationManager {
+	return &AssociationManager{Service: service, Conn: conn, assocs: make(map[string]*Association)}
+}
+
+// AddPeer configures a symmetric active association with addr. A non-zero
+// keyID must name a key in the service's key store; both directions are
+// then authenticated with it.
+func (m *AssociationManager) AddPeer(addr *net.UDPAddr, keyID uint32, poll time.Duration) (*Association, error) {
+	return m.add(addr, ModeSymmetricActive, keyID, poll)
+}
+
+// AddServer configures a client association that polls the server at addr.
+func (m *AssociationManager) AddServer(addr *net.UDPAddr, keyID uint32, poll time.Duration) (*Association, error) {
+	return m.add(addr, ModeClient, keyID, poll)
+}
+
+func (m *AssociationManager) add(addr *net.UDPAddr, mode uint8, keyID uint32, poll time.Duration) (*Association, error) {
+	if keyID != 0 {
+		if _, ok := m.Service.Keys.Lookup(keyID); !ok {
+			return nil, fmt.Errorf("association %s: %w %d", addr, ErrUnknownKey, keyID)
+		}
+	}
+	if poll <= 0 {
+		poll = DefaultPeerPoll
+	}
+	a := &Association{Addr: addr, HostMode: mode, KeyID: keyID, Poll: poll}
+	m.mu.Lock()
+	a.ID = m.newID()
+	m.assocs[addr.String()] = a
+	m.mu.Unlock()
+	return a, nil
+}
+
+// newID returns the next association ID. The caller holds m.mu.
+func (m *AssociationManager) newID() uint16 {
+	if m.lastID++; m.lastID == 0 {
+		m.lastID = 1 //0表示系统本身
+	}
+	return m.lastID
+}
+
+// Has reports whether an association with addr exists.
+func (m *AssociationManager) Has(addr *net.UDPAddr) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.assocs[addr.String()]
+	return ok
+}
+
+// SystemPeer returns the association ID of the selected time source, 0 if
+// there is none, and the jitter between the combined sources.
+func (m *AssociationManager) SystemPeer() (uint16, time.Duration) {
+	if m == nil {
+		return 0, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sysPeer, m.sysJitter
+}
+
+// Associations returns a snapshot of every association, sorted by address.
+func (m *AssociationManager) Associations() []Association {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Association, 0, len(m.assocs))
+	for _, a := range m.assocs {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr.String() < list[j].Addr.String() })
+	return list
+}
+
+// Run polls the active associations until stop is closed.
+func (m *AssociationManager) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		m.poll(time.Now())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *AssociationManager) poll(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, a := range m.assocs {
+		if now.Before(a.nextPoll) {
+			continue
+		}
+		a.nextPoll = now.Add(a.Poll)
+		if a.Reach <<= 1; a.Reach == 0 {
+			a.Select = SelectReject //连续8次不可达，不再参与选择
+		}
+		if a.HostMode == ModeSymmetricPassive || a.HostMode == HostModeBroadcastClient {
+			// 被动和广播关联不主动发送，只在对端停止发送后撤销
+			if a.idle++; a.idle >= passiveTimeout {
+				fmt.Println("Demobilizing association with", a.Addr, "mode", a.HostMode)
+				delete(m.assocs, key)
+			}
+			continue
+		}
+		m.transmit(a)
+	}
+}
+
+// HandlePacket processes a mode 1, 2 or 4 packet received at recvTime.
+// Packets from known peers and servers update their association; an
+// authenticated mode 1 packet from an unknown address mobilizes a passive
+// association.
+func (m *AssociationManager) HandlePacket(buf []byte, addr *net.UDPAddr, recvTime time.Time) {
+	pkt, err := ParseNTPPacket(buf)
+	if err != nil {
+		m.Service.debugln("Error parsing peer packet from", addr, err)
+		return
+	}
+	var keyID uint32
+	if pkt.Auth != nil && !pkt.Auth.IsCryptoNAK() {
+		key, err := m.Service.Keys.Verify(buf, pkt.Auth)
+		if err != nil {
+			m.Service.debugln("Peer authentication failed:", addr, "key", pkt.Auth.KeyID, err)
+			return
+		}
+		keyID = key.ID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.assocs[addr.String()]
+	if !ok {
+		// 未配置的对端：只有经过认证的主动对等体报文才建立被动关联，
+		// 防止任意地址借助对等体模式影响本机时间
+		if pkt.Mode != ModeSymmetricActive || keyID == 0 {
+			m.Service.debugln("Dropping packet without association from", addr)
+			return
+		}
+		a = &Association{ID: m.newID(), Addr: addr, HostMode: ModeSymmetricPassive, KeyID: keyID, Poll: pollDuration(pkt.PollInterval)}
+		m.assocs[addr.String()] = a
+		fmt.Println("Mobilizing passive peer", addr, "key", keyID)
+	}
+	if keyID != a.KeyID {
+		m.Service.debugln("Peer packet from", addr, "has key", keyID, "expected", a.KeyID)
+		return
+	}
+	m.receive(a, &pkt, recvTime)
+	if a.HostMode == ModeSymmetricPassive && pkt.Mode == ModeSymmetricActive {
+		m.transmit(a) //被动端收到即回复
+	}
+}
+
+// receive runs the on-wire protocol of RFC 5905 8 for one packet.
+func (m *AssociationManager) receive(a *Association, pkt *NTPv4Packet, recvTime time.Time) {
+	dst := NewNtpTimestamp(recvTime)
+	switch {
+	case pkt.TransmitTimestamp.IsZero():
+		m.Service.debugln("Invalid peer packet from", a.Addr, "(zero transmit timestamp)")
+		return
+	case pkt.TransmitTimestamp == a.org:
+		m.Service.debugln("Duplicate peer packet from", a.Addr)
+		return
+	case pkt.OrigTimestamp != a.xmt && !(pkt.OrigTimestamp.IsZero() && a.HostMode != ModeClient):
+		// 不是对本端最近一次发送的应答：过期或伪造的报文，不能更新org/rec，
+		// 否则路径外的攻击者无需知道本端的发送时间戳就能打断交换或发送KoD。
+		// 只有对等体在尚未收到本端报文时Origin为0
+		m.Service.debugln("Bogus peer packet from", a.Addr, "(origin does not match)")
+		return
+	}
+	a.org = pkt.TransmitTimestamp
+	a.rec = dst
+	a.idle = 0
+
+	if pkt.OrigTimestamp.IsZero() {
+		// 对等体尚未收到本端报文：保存时间戳，本轮不产生样本，也不接受KoD
+		return
+	}
+	if pkt.Stratum == 0 {
+		m.kiss(a, pkt)
+		return
+	}
+	if pkt.RecvTimestamp.IsZero() {
+		return
+	}
+
+	// T1 本端发送 T2 对端接收 T3 对端发送 T4 本端接收
+	// T1、T4换算为本地时钟读数：交换期间Service.Sync可能被其他源更新
+	t1 := pkt.OrigTimestamp.TimeNear(recvTime).Add(-a.xmtClockOffset)
+	t2 := pkt.RecvTimestamp.TimeNear(recvTime)
+	t3 := pkt.TransmitTimestamp.TimeNear(recvTime)
+	t4 := recvTime.Add(-m.Service.ClockOffset())
+	offset := (t2.Sub(t1) + t3.Sub(t4)) / 2 //对端时间 - 本地时钟
+	delay := t4.Sub(t1) - t3.Sub(t2)
+	m.sample(a, pkt, offset, delay, recvTime)
+}
+
+// sample records the upstream state in pkt and one offset/delay sample
+// measured against the local Clock, then reruns source selection when the
+// clock filter has something new. The caller holds m.mu.
+func (m *AssociationManager) sample(a *Association, pkt *NTPv4Packet, offset, delay time.Duration, recvTime time.Time) {
+	a.Reach |= 1
+	a.Leap = pkt.LeapIndicator
+	a.Stratum = pkt.Stratum
+	a.RefID = pkt.ReferenceID
+	a.RefTime = pkt.RefTimestamp
+	a.Precision = pkt.Precision
+	a.RootDelay = NtpShortToDuration(pkt.RootDelay)
+	a.RootDisp = NtpShortToDuration(pkt.RootDisp)
+	a.Updated = recvTime
+	// 样本按相对本地时钟保存，显示时换算回相对服务时间
+	fresh := a.clockFilter(offset, delay, recvTime)
+	a.Offset = a.clockOffset - m.Service.ClockOffset()
+	m.Service.debugf("association %s stratum %d offset %v delay %v reach %03o\n", a.Addr, a.Stratum, a.Offset, a.Delay, a.Reach)
+	if fresh && m.Service.Sync != nil {
+		m.selectSources(recvTime)
+	}
+}
+
+// broadcastSample feeds a sample from an authenticated, calibrated mode 5
+// packet into the association of its server, mobilizing one on first use,
+// so that broadcast servers take part in source selection like any other.
+// delay is the calibrated round trip. A server that is also configured as
+// a unicast upstream is only used through the unicast association.
+func (m *AssociationManager) broadcastSample(addr *net.UDPAddr, keyID uint32, pkt *NTPv4Packet, offset, delay time.Duration, recvTime time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.assocs[addr.String()]
+	if !ok {
+		a = &Association{ID: m.newID(), Addr: addr, HostMode: HostModeBroadcastClient, KeyID: keyID, Poll: pollDuration(pkt.PollInterval)}
+		a.nextPoll = recvTime.Add(a.Poll)
+		m.assocs[addr.String()] = a
+		fmt.Println("Mobilizing broadcast association", addr, "key", keyID)
+	}
+	if a.HostMode != HostModeBroadcastClient {
+		return
+	}
+	a.idle = 0
+	m.sample(a, pkt, offset, delay, recvTime)
+}
+
+// kiss handles a kiss-o'-death packet from a peer.
+func (m *AssociationManager) kiss(a *Association, pkt *NTPv4Packet) {
+	code := pkt.KissCode()
+	m.Service.debugln("Kiss-o'-Death", code, "from peer", a.Addr)
+	switch code {
+	case KissRate:
+		if a.Poll *= 2; a.Poll > maxPeerPoll {
+			a.Poll = maxPeerPoll
+		}
+		a.nextPoll = time.Now().Add(a.Poll)
+	case KissDeny, KissRestrict:
+		delete(m.assocs, a.Addr.String())
+	}
+}
+
+// transmit sends the next packet of the exchange to a peer. The caller
+// holds m.mu.
+func (m *AssociationManager) transmit(a *Association) {
+	now := m.Service.Now()
+	resp, err := newServerPacket(m.Service.SystemVars(now)).
+		Mode(a.HostMode).
+		Poll(pollExponent(a.Poll)).
+		Origin(a.org). //T3 对端最近的发送时间戳
+		Receive(a.rec).
+		Bytes()
+	if err != nil {
+		fmt.Println("Error creating peer packet:", err)
+		return
+	}
+	StampTransmitTimestamp(resp, m.Service.Now())
+	a.xmt = NtpTimestamp(binary.BigEndian.Uint64(resp[40:48]))
+	a.xmtClockOffset = m.Service.ClockOffset()
+	if a.KeyID != 0 {
+		key, ok := m.Service.Keys.Lookup(a.KeyID)
+		if !ok {
+			fmt.Println("Peer key", a.KeyID, "no longer in key store")
+			return
+		}
+		resp = key.Sign(resp)
+	}
+	if _, err := m.Conn.WriteToUDP(resp, a.Addr); err != nil {
+		fmt.Println("Error sending peer packet:", err)
+	}
+}
+
+// pollExponent returns the log2 seconds encoding of a poll interval.
+func pollExponent(d time.Duration) int8 {
+	var exp int8
+	for s := d / time.Second; s > 1; s >>= 1 {
+		exp++
+	}
+	return exp
+}
+
+// pollDuration is the inverse of pollExponent, clamped to 16s-1024s.
+func pollDuration(exp int8) time.Duration {
+	if exp < 4 {
+		exp = 4
+	}
+	if exp > 10 {
+		exp = 10
+	}
+	return time.Second << uint(exp)
+}
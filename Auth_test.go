@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAESCMACVectors checks the examples of RFC 4493 4.
+func TestAESCMACVectors(t *testing.T) {
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	msg, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172a" +
+		"ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52ef" +
+		"f69f2445df4f9b17ad2b417be66c3710")
+	tests := []struct {
+		length int
+		mac    string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+	for _, tt := range tests {
+		mac, err := aesCMAC(key, msg[:tt.length])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(mac); got != tt.mac {
+			t.Errorf("%d byte message: %s, want %s", tt.length, got, tt.mac)
+		}
+	}
+}
+
+func writeKeyFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ntp.keys")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	ks, err := LoadKeyFile(writeKeyFile(t, `# ntp.keys
+1 MD5 secret        # printable ASCII
+2 SHA1 0123456789abcdef0123456789abcdef01234567
+3 AES128CMAC 2b7e151628aed2a6abf7158809cf4f3c
+
+4 M short
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id     uint32
+		typ    string
+		secret string
+	}{
+		{1, KeyTypeMD5, "secret"},
+		{2, KeyTypeSHA1, "\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67"},
+		{3, KeyTypeAES128CMAC, "\x2b\x7e\x15\x16\x28\xae\xd2\xa6\xab\xf7\x15\x88\x09\xcf\x4f\x3c"},
+		{4, KeyTypeMD5, "short"},
+	}
+	for _, tt := range tests {
+		key, ok := ks.Lookup(tt.id)
+		if !ok {
+			t.Errorf("key %d missing", tt.id)
+			continue
+		}
+		if key.Type != tt.typ || string(key.Secret) != tt.secret {
+			t.Errorf("key %d: %s % x, want %s % x", tt.id, key.Type, key.Secret, tt.typ, tt.secret)
+		}
+	}
+	if _, ok := ks.Lookup(5); ok {
+		t.Error("found key 5")
+	}
+}
+
+func TestLoadKeyFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"missing key", "1 MD5"},
+		{"key ID zero", "0 MD5 secret"},
+		{"key ID beyond 65535", "65536 MD5 secret"},
+		{"unknown type", "1 SHA256 secret"},
+		{"long key not hex", "1 MD5 this-is-not-a-hex-string"},
+		{"short CMAC key", "1 AES128CMAC 2b7e151628aed2a6abf7158809cf4f"},
+	}
+	for _, tt := range tests {
+		_, err := LoadKeyFile(writeKeyFile(t, "# comment\n"+tt.line+"\n"))
+		if err == nil || !strings.Contains(err.Error(), ":2:") {
+			t.Errorf("%s: err %v, want one naming line 2", tt.name, err)
+		}
+	}
+}
+
+// TestMACRoundTrip signs a request with each key type and checks that the
+// key store accepts it and rejects it once a byte has changed.
+func TestMACRoundTrip(t *testing.T) {
+	ks := NewKeyStore()
+	cmacKey, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	for _, key := range []*SymmetricKey{
+		{ID: 1, Type: KeyTypeMD5, Secret: []byte("secret")},
+		{ID: 2, Type: KeyTypeSHA1, Secret: []byte("secret")},
+		{ID: 3, Type: KeyTypeAES128CMAC, Secret: cmacKey},
+	} {
+		ks.Add(key)
+		req, _, err := newClientRequest(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := key.Sign(req)
+		pkt, err := ParseNTPPacket(signed)
+		if err != nil || pkt.Auth == nil {
+			t.Fatalf("%s: parse signed request: %v", key.Type, err)
+		}
+		if got, err := ks.Verify(signed, pkt.Auth); err != nil || got != key {
+			t.Errorf("%s: verify %v", key.Type, err)
+		}
+		signed[40] ^= 1
+		if _, err := ks.Verify(signed, pkt.Auth); err != ErrBadMAC {
+			t.Errorf("%s: altered request: err %v, want %v", key.Type, err, ErrBadMAC)
+		}
+	}
+}
+
+// TestCryptoNAK checks that a request signed with a key the server does
+// not have is answered with a crypto-NAK, and one with a known key is
+// answered with a MAC made by that key.
+func TestCryptoNAK(t *testing.T) {
+	known := &SymmetricKey{ID: 1, Type: KeyTypeSHA1, Secret: []byte("secret")}
+	keys := NewKeyStore()
+	keys.Add(known)
+	server := serveNTP(t, &NTPService{Keys: keys})
+
+	req, _, err := newClientRequest(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := &SymmetricKey{ID: 2, Type: KeyTypeSHA1, Secret: []byte("secret")}
+	buf := exchange(t, server, unknown.Sign(append([]byte(nil), req...)), time.Second)
+	if buf == nil {
+		t.Fatal("no reply to a request with an unknown key")
+	}
+	if len(buf) != 52 || !bytes.Equal(buf[48:], []byte{0, 0, 0, 0}) {
+		t.Errorf("reply % x, want a 48 byte header and a crypto-NAK", buf)
+	}
+
+	buf = exchange(t, server, known.Sign(append([]byte(nil), req...)), time.Second)
+	if buf == nil {
+		t.Fatal("no reply to a request with a known key")
+	}
+	resp, err := ParseNTPPacket(buf)
+	if err != nil || resp.Auth == nil || resp.Auth.IsCryptoNAK() {
+		t.Fatalf("reply % x is not signed: %v", buf, err)
+	}
+	if err := known.Verify(buf, resp.Auth); err != nil {
+		t.Errorf("reply MAC: %v", err)
+	}
+}
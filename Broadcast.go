@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultBroadcastInterval = 64 * time.Second //广播间隔 2^6秒
+	DefaultMulticastTTL      = 1                //组播默认只发送到本网段
+)
+
+// Well-known NTP multicast groups (IANA)
+var (
+	NtpMulticastIPv4 = net.IPv4(224, 0, 1, 1)   //NTP组播 224.0.1.1
+	NtpMulticastIPv6 = net.ParseIP("ff05::101") //站点范围 All NTP Servers
+)
+
+// Broadcaster periodically sends mode 5 packets to broadcast addresses and
+// multicast groups for clients that only listen (RFC 5905 3).
+type Broadcaster struct {
+	Service   *NTPService
+	Targets   []*net.UDPAddr //IPv4广播地址、组播组，或用于测试的单播地址
+	Interval  time.Duration  //发送间隔
+	TTL       int            //组播TTL/跳数限制
+	Interface *net.Interface //组播出接口，nil表示由路由表决定
+	KeyID     uint32         //对称密钥ID，0表示不认证
+}
+
+// ParseBroadcastTargets parses a comma separated list of addresses, with
+// port 123 when none is given.
+func ParseBroadcastTargets(list string) ([]*net.UDPAddr, error) {
+	var targets []*net.UDPAddr
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(item); err != nil {
+			item = net.JoinHostPort(strings.Trim(item, "[]"), "123")
+		}
+		addr, err := net.ResolveUDPAddr("udp", item)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, addr)
+	}
+	return targets, nil
+}
+
+// ParseMulticastGroups parses a comma separated list of multicast addresses.
+func ParseMulticastGroups(list string) ([]net.IP, error) {
+	var groups []net.IP
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		group := net.ParseIP(strings.Trim(item, "[]"))
+		if group == nil || !group.IsMulticast() {
+			return nil, fmt.Errorf("invalid multicast group %q", item)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// Run sends a broadcast packet to every target each Interval until stop is
+// closed. IPv4 and IPv6 targets get their own socket so the multicast TTL
+// and interface can be set per family.
+func (b *Broadcaster) Run(stop <-chan struct{}) error {
+	if b.KeyID != 0 {
+		if _, ok := b.Service.Keys.Lookup(b.KeyID); !ok {
+			return fmt.Errorf("broadcast: %w %d", ErrUnknownKey, b.KeyID)
+		}
+	}
+	interval := b.Interval
+	if interval <= 0 {
+		interval = DefaultBroadcastInterval
+	}
+	conns := make(map[bool]*net.UDPConn) //key: 是否IPv6
+	for _, t := range b.Targets {
+		ipv6 := t.IP.To4() == nil
+		if conns[ipv6] != nil {
+			continue
+		}
+		conn, err := b.listen(ipv6)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conns[ipv6] = conn
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		b.send(conns, interval)
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *Broadcaster) listen(ipv6 bool) (*net.UDPConn, error) {
+	network := "udp4"
+	if ipv6 {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	ttl := b.TTL
+	if ttl <= 0 {
+		ttl = DefaultMulticastTTL
+	}
+	if err := setMulticastOptions(conn, ipv6, ttl, b.Interface); err != nil {
+		fmt.Println("WARNING: cannot set multicast TTL/interface:", err)
+	}
+	return conn, nil
+}
+
+// send builds one broadcast packet per target. The Transmit Timestamp is
+// stamped per target so it stays as close to the write as possible.
+func (b *Broadcaster) send(conns map[bool]*net.UDPConn, interval time.Duration) {
+	for _, t := range b.Targets {
+		now := b.Service.Now()
+		pkt, err := newServerPacket(b.Service.SystemVars(now)).
+			Mode(ModeBroadcast).          //广播模式5 Origin/Receive为0
+			Poll(pollExponent(interval)). //告知客户端广播间隔
+			Bytes()
+		if err != nil {
+			fmt.Println("Error creating broadcast packet:", err)
+			return
+		}
+		StampTransmitTimestamp(pkt, b.Service.Now())
+		if b.KeyID != 0 {
+			key, _ := b.Service.Keys.Lookup(b.KeyID)
+			pkt = key.Sign(pkt)
+		}
+		if _, err := conns[t.IP.To4() == nil].WriteToUDP(pkt, t); err != nil {
+			fmt.Println("Error sending broadcast packet to", t, err)
+		}
+	}
+}
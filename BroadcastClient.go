@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	broadcastCalibrationSamples = 4               //标定时的客户端/服务端交换次数
+	broadcastCalibrationTimeout = 2 * time.Second //每次交换的超时
+)
+
+// BroadcastClient learns the time from mode 5 packets. The first packets
+// from a server trigger a few client/server exchanges to calibrate the
+// one-way delay; after that each broadcast packet is a sample for the
+// server's association in Assocs, which selects among broadcast servers,
+// peers and unicast servers alike.
+type BroadcastClient struct {
+	Service *NTPService
+	Assocs  *AssociationManager
+	Allow   []*net.IPNet //允许的广播服务器，nil表示不限制
+	KeyID   uint32       //非0时只接受用该密钥签名的广播报文，标定请求也用它签名
+	Port    int          //标定时向广播服务器查询的端口，0表示123
+
+	mu      sync.Mutex
+	servers map[string]*broadcastServer
+}
+
+type broadcastServer struct {
+	calibrating bool
+	calibrated  bool
+	delay       time.Duration //单向延迟 = 标定得到的最小往返延迟/2
+	lastXmt     time.Time     //最近接受的广播的发送时间，更早的报文是重复或重放
+}
+
+// HandlePacket processes a mode 5 packet received at recvTime.
+func (c *BroadcastClient) HandlePacket(buf []byte, addr *net.UDPAddr, recvTime time.Time) {
+	if c.Allow != nil && !containsIP(c.Allow, addr.IP) {
+		return
+	}
+	pkt, err := ParseNTPPacket(buf)
+	if err != nil {
+		c.Service.debugln("Error parsing broadcast packet:", err)
+		return
+	}
+	if c.KeyID != 0 {
+		if pkt.Auth == nil || pkt.Auth.KeyID != c.KeyID {
+			c.Service.debugln("Dropping unauthenticated broadcast from", addr)
+			return
+		}
+		if _, err := c.Service.Keys.Verify(buf, pkt.Auth); err != nil {
+			c.Service.debugln("Broadcast authentication failed:", addr, err)
+			return
+		}
+	}
+	if pkt.Stratum == 0 || pkt.Stratum >= 16 || pkt.LeapIndicator == LeapNotInSync || pkt.TransmitTimestamp.IsZero() {
+		return
+	}
+
+	key := addr.IP.String()
+	t3 := pkt.TransmitTimestamp.TimeNear(recvTime)
+	c.mu.Lock()
+	if c.servers == nil {
+		c.servers = make(map[string]*broadcastServer)
+	}
+	s, ok := c.servers[key]
+	if !ok {
+		s = &broadcastServer{}
+		c.servers[key] = s
+		fmt.Println("New broadcast server", key)
+	}
+	if !t3.After(s.lastXmt) {
+		c.mu.Unlock()
+		c.Service.debugln("Dropping duplicate or replayed broadcast from", addr)
+		return
+	}
+	s.lastXmt = t3
+	if !s.calibrated {
+		if !s.calibrating {
+			s.calibrating = true
+			port := c.Port
+			if port == 0 {
+				port = 123
+			}
+			go c.calibrate(key, &net.UDPAddr{IP: addr.IP, Port: port, Zone: addr.Zone})
+		}
+		c.mu.Unlock()
+		return
+	}
+	delay := s.delay
+	c.mu.Unlock()
+
+	// 广播报文只有T3：偏差 = T3 + 单向延迟 - T4，T4换算为本地时钟读数
+	clockRecv := recvTime.Add(-c.Service.ClockOffset())
+	offset := t3.Add(delay).Sub(clockRecv)
+	c.Assocs.broadcastSample(addr, c.KeyID, &pkt, offset, 2*delay, recvTime) //往返延迟为标定的单向延迟的两倍
+}
+
+// calibrate measures the round trip delay to a broadcast server with
+// ordinary client requests and keeps the smallest. With KeyID set the
+// requests are signed and unauthenticated answers are ignored, so that the
+// delay cannot be forged either.
+func (c *BroadcastClient) calibrate(key string, addr *net.UDPAddr) {
+	var auth *SymmetricKey
+	if c.KeyID != 0 {
+		var ok bool
+		if auth, ok = c.Service.Keys.Lookup(c.KeyID); !ok {
+			fmt.Println("Broadcast delay calibration with", addr, "refused:", ErrUnknownKey, c.KeyID)
+			c.mu.Lock()
+			c.servers[key].calibrating = false
+			c.mu.Unlock()
+			return
+		}
+	}
+	var best Sample
+	ok := false
+	for i := 0; i < broadcastCalibrationSamples; i++ {
+		sample, err := QueryServer(addr, broadcastCalibrationTimeout, c.Service.Clock, auth)
+		if err != nil {
+			fmt.Println("Broadcast delay calibration with", addr, "failed:", err)
+			continue
+		}
+		if !ok || sample.Delay < best.Delay {
+			best, ok = sample, true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.servers[key]
+	s.calibrating = false
+	if !ok {
+		return //下一个广播报文会重新标定
+	}
+	if best.Delay < 0 {
+		best.Delay = 0
+	}
+	s.delay = best.Delay / 2
+	s.calibrated = true
+	fmt.Println("Broadcast server", key, "calibrated: one-way delay", s.delay)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestBroadcasterLoopback sends signed mode 5 packets to a unicast socket
+// on 127.0.0.1 and checks their contents and spacing.
+func TestBroadcasterLoopback(t *testing.T) {
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	keys := NewKeyStore()
+	key := &SymmetricKey{ID: 3, Type: KeyTypeSHA1, Secret: []byte("broadcast")}
+	keys.Add(key)
+	const interval = 100 * time.Millisecond
+	b := &Broadcaster{
+		Service:  &NTPService{Keys: keys},
+		Targets:  []*net.UDPAddr{sink.LocalAddr().(*net.UDPAddr)},
+		Interval: interval,
+		KeyID:    key.ID,
+	}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- b.Run(stop) }()
+
+	sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, MaxPacketSize)
+	var times []time.Time
+	for len(times) < 2 {
+		n, _, err := sink.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pkt NTPv4Packet
+		if err := pkt.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Mode != ModeBroadcast || pkt.Version != 4 || pkt.Stratum != localStratum {
+			t.Fatalf("mode %d version %d stratum %d, want 5 4 %d", pkt.Mode, pkt.Version, pkt.Stratum, localStratum)
+		}
+		if !pkt.OrigTimestamp.IsZero() || !pkt.RecvTimestamp.IsZero() {
+			t.Error("broadcast packet carries origin or receive timestamps")
+		}
+		if pkt.PollInterval != pollExponent(interval) {
+			t.Errorf("poll %d, want %d", pkt.PollInterval, pollExponent(interval))
+		}
+		if pkt.Auth == nil || pkt.Auth.KeyID != key.ID {
+			t.Fatalf("MAC %+v, want key %d", pkt.Auth, key.ID)
+		}
+		if _, err := keys.Verify(buf[:n], pkt.Auth); err != nil {
+			t.Fatal("broadcast MAC:", err)
+		}
+		xmt := pkt.TransmitTimestamp.Time()
+		if d := time.Since(xmt); d < 0 || d > time.Second {
+			t.Errorf("transmit timestamp %v is %v old", xmt, d)
+		}
+		times = append(times, xmt)
+	}
+	if gap := times[1].Sub(times[0]); gap < interval/2 || gap > 3*interval {
+		t.Errorf("packets %v apart, want about %v", gap, interval)
+	}
+
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Run:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Run did not return after stop")
+	}
+}
+
+// TestBroadcastClientLoopback feeds signed broadcasts from a server running
+// 2s ahead to a BroadcastClient, which calibrates its delay against the same
+// server with signed requests and then selects it as its time source.
+func TestBroadcastClientLoopback(t *testing.T) {
+	keys := NewKeyStore()
+	keys.Add(&SymmetricKey{ID: 5, Type: KeyTypeAES128CMAC, Secret: []byte("0123456789abcdef")})
+	upstream := &NTPService{Sync: &SyncState{}, Keys: keys}
+	upstream.Sync.Set(SyncUpdate{Offset: 2 * time.Second, Source: net.IPv4(192, 0, 2, 1), Stratum: 1}, time.Now())
+	server := serveNTP(t, upstream)
+
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	b := &Broadcaster{
+		Service:  upstream,
+		Targets:  []*net.UDPAddr{sink.LocalAddr().(*net.UDPAddr)},
+		Interval: 50 * time.Millisecond,
+		KeyID:    5,
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go b.Run(stop)
+
+	ntp := &NTPService{Sync: &SyncState{}, Keys: keys}
+	assocs := NewAssociationManager(ntp, nil)
+	client := &BroadcastClient{Service: ntp, Assocs: assocs, KeyID: 5, Port: server.Port}
+	sink.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, MaxPacketSize)
+	var from *net.UDPAddr
+	var n int
+	for !ntp.Sync.Synchronized(time.Now()) {
+		if n, from, err = sink.ReadFromUDP(buf); err != nil {
+			t.Fatal("client never synchronised:", err)
+		}
+		client.HandlePacket(buf[:n], from, ntp.Now())
+	}
+	last, _ := ntp.Sync.Last()
+	if d := last.Offset - 2*time.Second; d < -20*time.Millisecond || d > 20*time.Millisecond {
+		t.Errorf("offset %v, want about 2s", last.Offset)
+	}
+	if !last.Source.Equal(loopback) || last.Stratum != 2 {
+		t.Errorf("source %v stratum %d, want %v stratum 2", last.Source, last.Stratum, loopback)
+	}
+	list := assocs.Associations()
+	if len(list) != 1 || list[0].HostMode != HostModeBroadcastClient || list[0].Select != SelectSystemPeer {
+		t.Fatalf("associations %+v, want one selected broadcast association", list)
+	}
+
+	// 重放最后一个已接受的广播：不产生新样本
+	updated := list[0].Updated
+	client.HandlePacket(buf[:n], from, ntp.Now().Add(time.Second))
+	if a := assocs.Associations()[0]; !a.Updated.Equal(updated) {
+		t.Error("replayed broadcast was accepted")
+	}
+}
+
+// TestBroadcastCalibrationNeedsKey checks that a signed calibration query
+// does not accept an answer from a server without the key.
+func TestBroadcastCalibrationNeedsKey(t *testing.T) {
+	key := &SymmetricKey{ID: 5, Type: KeyTypeSHA1, Secret: []byte("broadcast")}
+	ntp := &NTPService{Sync: &SyncState{}}
+	ntp.Sync.Set(SyncUpdate{Source: net.IPv4(192, 0, 2, 1), Stratum: 1}, time.Now())
+	server := serveNTP(t, ntp)
+	if _, err := QueryServer(server, 200*time.Millisecond, nil, nil); err != nil {
+		t.Fatal("unsigned query:", err)
+	}
+	if _, err := QueryServer(server, 200*time.Millisecond, nil, key); err == nil {
+		t.Error("signed query accepted an unauthenticated answer")
+	}
+}
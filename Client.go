@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrUnsynchronized is returned when a server reports LI=3 or stratum 16.
+var ErrUnsynchronized = errors.New("ntp: server not synchronized")
+
+// KissError is returned when a server answers with a kiss-o'-death packet.
+type KissError struct {
+	Code string
+}
+
+func (e *KissError) Error() string {
+	return fmt.Sprintf("ntp: kiss-o'-death %s", e.Code)
+}
+
+// Sample is the result of one client/server exchange (RFC 5905 8).
+type Sample struct {
+	Offset    time.Duration //服务器时间 - 本地时钟
+	Delay     time.Duration //往返延迟，不含服务器处理时间
+	Leap      uint8
+	Stratum   uint8
+	RefID     uint32
+	RootDelay time.Duration
+	RootDisp  time.Duration
+	Time      time.Time //收到应答的本地时钟时间 T4
+}
+
+// QueryServer sends one mode 3 request to addr and measures the server
+// against clock. A nil clock is the system clock. With a non-nil key the
+// request is signed and only a response signed with the same key counts.
+func QueryServer(addr *net.UDPAddr, timeout time.Duration, clock Clock, key *SymmetricKey) (Sample, error) {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return Sample{}, err
+	}
+	defer conn.Close()
+
+	req, xmt, err := newClientRequest(clock.Now())
+	if err != nil {
+		return Sample{}, err
+	}
+	if key != nil {
+		req = key.Sign(req)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	t1 := clock.Now()
+	if _, err := conn.Write(req); err != nil {
+		return Sample{}, err
+	}
+
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		t4 := clock.Now()
+		if err != nil {
+			return Sample{}, err
+		}
+		var resp NTPv4Packet
+		if err := resp.UnmarshalBinary(buf[:n]); err != nil || resp.Mode != ModeServer || resp.OrigTimestamp != xmt {
+			continue //不是对本次请求的应答
+		}
+		if key != nil && (resp.Auth == nil || key.Verify(buf[:n], resp.Auth) != nil) {
+			continue //未认证或认证失败的应答
+		}
+		return newSample(&resp, t1, t4)
+	}
+}
+
+// newClientRequest builds a mode 3 request sent at t1. The low 16 bits of
+// the Transmit Timestamp are random; the server echoes them in Origin, so a
+// forged response has to guess them.
+func newClientRequest(t1 time.Time) ([]byte, NtpTimestamp, error) {
+	req, err := NewPacketBuilder().Mode(ModeClient).Bytes()
+	if err != nil {
+		return nil, 0, err
+	}
+	var noise [2]byte
+	if _, err := rand.Read(noise[:]); err != nil {
+		return nil, 0, err
+	}
+	xmt := NtpTimestamp(uint64(NewNtpTimestamp(t1))&^0xffff | uint64(binary.BigEndian.Uint16(noise[:])))
+	binary.BigEndian.PutUint64(req[40:48], uint64(xmt))
+	return req, xmt, nil
+}
+
+// newSample computes offset and delay from a server response to a request
+// sent at t1 and received at t4, both read from the local clock.
+func newSample(resp *NTPv4Packet, t1, t4 time.Time) (Sample, error) {
+	if resp.Stratum == 0 {
+		return Sample{}, &KissError{Code: resp.KissCode()}
+	}
+	if resp.LeapIndicator == LeapNotInSync || resp.Stratum >= 16 || resp.TransmitTimestamp.IsZero() {
+		return Sample{}, ErrUnsynchronized
+	}
+	// T1 客户端发送 T2 服务端接收 T3 服务端发送 T4 客户端接收
+	t2 := resp.RecvTimestamp.TimeNear(t4)
+	t3 := resp.TransmitTimestamp.TimeNear(t4)
+	return Sample{
+		Offset:    (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		Delay:     t4.Sub(t1) - t3.Sub(t2),
+		Leap:      resp.LeapIndicator,
+		Stratum:   resp.Stratum,
+		RefID:     resp.ReferenceID,
+		RootDelay: NtpShortToDuration(resp.RootDelay),
+		RootDisp:  NtpShortToDuration(resp.RootDisp),
+		Time:      t4,
+	}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source the server reads. The system clock is used in
+// production; tests substitute a fake.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// DefaultSmearWindow is the noon-to-noon window used by public smearing
+// servers: 12 hours either side of the leap.
+const DefaultSmearWindow = 24 * time.Hour
+
+// LeapSmear hides leap seconds by slewing the served time linearly over a
+// window centred on the leap instead of announcing it with LI.
+type LeapSmear struct {
+	Table  *LeapTable
+	Window time.Duration
+
+	mu       sync.Mutex
+	lastWall time.Time //上一次观察到的系统时间，用于识别内核插入闰秒时的回拨
+	stepped  time.Time //内核已完成回拨的闰秒时刻
+}
+
+// active returns the leap whose smear window contains t, its direction
+// (+1 insert, -1 delete) and the window start.
+func (s *LeapSmear) active(t time.Time) (LeapEntry, int, time.Time, bool) {
+	if s == nil || s.Table == nil {
+		return LeapEntry{}, 0, time.Time{}, false
+	}
+	half := s.Window / 2
+	for i := 1; i < len(s.Table.Entries); i++ {
+		e := s.Table.Entries[i]
+		delta := e.TAIOffset - s.Table.Entries[i-1].TAIOffset
+		start := e.At.Add(-half)
+		end := e.At.Add(half + time.Second)
+		if delta != 0 && !t.Before(start) && t.Before(end) {
+			return e, delta, start, true
+		}
+	}
+	return LeapEntry{}, 0, time.Time{}, false
+}
+
+// Offset returns how far the served time is from the system clock at now.
+// It is zero outside a smear window.
+func (s *LeapSmear) Offset(now time.Time) time.Duration {
+	leap, delta, start, ok := s.active(now)
+	if !ok {
+		return 0
+	}
+	wall := now.Round(0) //去掉单调时钟读数，只比较墙上时间
+
+	s.mu.Lock()
+	// 插入闰秒时内核会把23:59:59重复一次：墙上时间回拨而单调时钟继续前进
+	if delta > 0 && !s.lastWall.IsZero() && wall.Before(s.lastWall.Add(-500*time.Millisecond)) &&
+		!wall.Before(leap.At.Add(-time.Second)) && wall.Before(leap.At) {
+		s.stepped = leap.At
+	}
+	if wall.After(s.lastWall) || s.lastWall.Sub(wall) > time.Hour {
+		s.lastWall = wall
+	}
+	stepped := s.stepped.Equal(leap.At)
+	s.mu.Unlock()
+
+	// continuous 为不重复/不跳过闰秒的连续时间
+	continuous := wall
+	if !wall.Before(leap.At) || stepped {
+		continuous = wall.Add(time.Duration(delta) * time.Second)
+	}
+	span := s.Window + time.Duration(delta)*time.Second
+	frac := float64(continuous.Sub(start)) / float64(span)
+	if frac > 1 {
+		frac = 1
+	}
+	served := continuous.Add(-time.Duration(frac * float64(time.Duration(delta)*time.Second)))
+	return served.Sub(wall)
+}
+
+// Smearing reports whether now is inside a smear window.
+func (s *LeapSmear) Smearing(now time.Time) bool {
+	_, _, _, ok := s.active(now)
+	return ok
+}
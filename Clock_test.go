@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that returns whatever the test set last.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+// leap2016 is the leap second inserted at the end of 2016.
+var leap2016 = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newSmearService(clock Clock) *NTPService {
+	table := &LeapTable{
+		Entries: []LeapEntry{
+			{At: time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC), TAIOffset: 36},
+			{At: leap2016, TAIOffset: 37},
+		},
+		Expires: time.Date(2017, 6, 28, 0, 0, 0, 0, time.UTC),
+	}
+	return &NTPService{
+		Clock: clock,
+		Leap:  table,
+		Smear: &LeapSmear{Table: table, Window: DefaultSmearWindow},
+	}
+}
+
+// kernelWall is the system clock reading at physical time p when the kernel
+// inserts the leap by repeating 23:59:59. p is counted on the pre-leap UTC
+// scale, so after the leap it runs one second ahead of the system clock.
+func kernelWall(p time.Time) time.Time {
+	if p.Before(leap2016) {
+		return p
+	}
+	return p.Add(-time.Second)
+}
+
+func TestLeapSmearOffset(t *testing.T) {
+	clock := &fakeClock{}
+	ntp := newSmearService(clock)
+	tests := []struct {
+		name     string
+		wall     time.Time
+		min, max time.Duration
+	}{
+		{"before window", leap2016.Add(-13 * time.Hour), 0, 0},
+		{"window start", leap2016.Add(-12 * time.Hour), 0, 0},
+		{"quarter", leap2016.Add(-6 * time.Hour), -251 * time.Millisecond, -249 * time.Millisecond},
+		{"just before leap", leap2016.Add(-time.Millisecond), -501 * time.Millisecond, -499 * time.Millisecond},
+		{"just after leap", leap2016, 499 * time.Millisecond, 501 * time.Millisecond},
+		{"three quarters", leap2016.Add(6 * time.Hour), 249 * time.Millisecond, 251 * time.Millisecond},
+		{"window end", leap2016.Add(12 * time.Hour), 0, 0},
+		{"after window", leap2016.Add(13 * time.Hour), 0, 0},
+	}
+	for _, tt := range tests {
+		clock.t = tt.wall
+		got := ntp.SmearOffset()
+		if got < tt.min || got > tt.max {
+			t.Errorf("%s: offset %v, want [%v, %v]", tt.name, got, tt.min, tt.max)
+		}
+		if want := tt.wall.Add(got); !ntp.Now().Equal(want) {
+			t.Errorf("%s: Now() = %v, want %v", tt.name, ntp.Now(), want)
+		}
+		if li := ntp.SystemVars(ntp.Now()).Leap; li != LeapNoWarning {
+			t.Errorf("%s: LI = %d while smearing, want 0", tt.name, li)
+		}
+	}
+}
+
+// TestLeapSmearMonotonic walks physical time across the whole window and
+// checks that the served time only moves forward and that its offset from
+// physical time only grows more negative, by one second in total.
+func TestLeapSmearMonotonic(t *testing.T) {
+	clock := &fakeClock{}
+	ntp := newSmearService(clock)
+	start := leap2016.Add(-12*time.Hour - 30*time.Second)
+	end := leap2016.Add(12*time.Hour + 2*time.Minute)
+
+	var lastServed time.Time
+	lastOffset := time.Duration(0)
+	for p := start; p.Before(end); p = p.Add(time.Minute) {
+		clock.t = kernelWall(p)
+		served := ntp.Now()
+		offset := served.Sub(p)
+		if !lastServed.IsZero() && !served.After(lastServed) {
+			t.Fatalf("at %v: served %v not after %v", p, served, lastServed)
+		}
+		if offset > lastOffset {
+			t.Fatalf("at %v: offset from physical time %v rose from %v", p, offset, lastOffset)
+		}
+		lastServed, lastOffset = served, offset
+	}
+	if lastOffset != -time.Second {
+		t.Errorf("offset after window %v, want -1s", lastOffset)
+	}
+}
+
+// TestLeapSmearKernelStep reads the clock every 100ms while the kernel
+// repeats 23:59:59. The served time must advance by the same amount each
+// read, with no jump when the system clock steps back.
+func TestLeapSmearKernelStep(t *testing.T) {
+	clock := &fakeClock{}
+	ntp := newSmearService(clock)
+	const step = 100 * time.Millisecond
+
+	var lastWall, lastServed time.Time
+	stepped := false
+	for p := leap2016.Add(-3 * time.Second); p.Before(leap2016.Add(3 * time.Second)); p = p.Add(step) {
+		clock.t = kernelWall(p)
+		if clock.t.Before(lastWall) {
+			stepped = true
+		}
+		served := ntp.Now()
+		if !lastServed.IsZero() {
+			if d := served.Sub(lastServed); d < step-time.Millisecond || d > step+time.Millisecond {
+				t.Fatalf("at wall %v: served time advanced %v, want about %v", clock.t, d, step)
+			}
+		}
+		lastWall, lastServed = clock.t, served
+	}
+	if !stepped {
+		t.Fatal("test clock never stepped back")
+	}
+}
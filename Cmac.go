@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// cmacRb is the constant used for subkey generation with a 128-bit block
+// cipher (RFC 4493 2.3).
+const cmacRb = 0x87
+
+// aesCMAC computes the AES-CMAC of msg (RFC 4493). key must be 16, 24 or
+// 32 bytes.
+func aesCMAC(key, msg []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cmacBlock(block, msg), nil
+}
+
+func cmacBlock(block cipher.Block, msg []byte) []byte {
+	var k1, k2 [aes.BlockSize]byte
+	block.Encrypt(k1[:], k1[:]) //L = AES(K, 0^128)
+	cmacDouble(&k1)
+	k2 = k1
+	cmacDouble(&k2)
+
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	complete := n > 0 && len(msg)%aes.BlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+	var last [aes.BlockSize]byte
+	tail := msg[(n-1)*aes.BlockSize:]
+	if complete {
+		xorBytes(last[:], tail, k1[:])
+	} else {
+		copy(last[:], tail)
+		last[len(tail)] = 0x80
+		xorBytes(last[:], last[:], k2[:])
+	}
+
+	var x [aes.BlockSize]byte
+	for i := 0; i < n-1; i++ {
+		xorBytes(x[:], x[:], msg[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(x[:], x[:])
+	}
+	xorBytes(x[:], x[:], last[:])
+	block.Encrypt(x[:], x[:])
+	return x[:]
+}
+
+// cmacDouble multiplies b by x in GF(2^128).
+func cmacDouble(b *[aes.BlockSize]byte) {
+	carry := b[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[aes.BlockSize-1] = b[aes.BlockSize-1]<<1 ^ carry*cmacRb
+}
+
+// xorBytes sets dst[i] = a[i] ^ b[i] for the length of the shorter input.
+func xorBytes(dst, a, b []byte) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		dst[i] = a[i] ^ b[i]
+	}
+}
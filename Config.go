@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultConfigFile    = "ntpserver.conf"
+	DefaultPromptTimeout = 10 * time.Second //无操作自动继续的时间
+)
+
+// ServerConfig is the content of ntpserver.conf:
+//
+//	#上级NTP服务器的IP地址 不填写表示本地时钟
+//	ntpserverip:10.10.10.10,[2001:db8::1]:123
+//	#更新频率 秒
+//	updatefrequency:3600
+//
+// Lines starting with # are comments; keys are case-insensitive. Several
+// upstream servers are separated by commas and are combined by source
+// selection.
+type ServerConfig struct {
+	Path            string
+	NtpServerIP     string        //上级NTP服务器，多个用逗号分隔，空表示直接使用本地时钟
+	UpdateFrequency time.Duration //向上级服务器请求的间隔，0表示默认值
+}
+
+// LoadServerConfig reads the config file at path. A missing file gives an
+// empty config, since every value is optional.
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &ServerConfig{Path: path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := ParseServerConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.Path = path
+	return cfg, nil
+}
+
+// ParseServerConfig parses the key:value format. Unknown keys are reported
+// and skipped so that newer files still load.
+func ParseServerConfig(r io.Reader) (*ServerConfig, error) {
+	cfg := &ServerConfig{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// 只按第一个冒号分割，IPv6地址和host:port中的冒号属于值
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key:value", n)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		switch key {
+		case "ntpserverip":
+			cfg.NtpServerIP = value
+		case "updatefrequency":
+			if value == "" {
+				continue
+			}
+			secs, err := strconv.Atoi(value)
+			if err != nil || secs <= 0 {
+				return nil, fmt.Errorf("line %d: updatefrequency must be a positive number of seconds", n)
+			}
+			cfg.UpdateFrequency = time.Duration(secs) * time.Second
+		default:
+			fmt.Printf("WARNING: line %d: unknown setting %q\n", n, key)
+		}
+	}
+	return cfg, scanner.Err()
+}
+
+// Save writes the config back to its Path in the documented layout.
+func (c *ServerConfig) Save() error {
+	// 未设置的值写成注释掉的默认值，与随程序发布的ntpserver.conf一致
+	server := "#ntpserverip:10.10.10.10"
+	if c.NtpServerIP != "" {
+		server = "ntpserverip:" + c.NtpServerIP
+	}
+	freq := fmt.Sprintf("#updatefrequency:%d", DefaultPeerPoll/time.Second)
+	if c.UpdateFrequency > 0 {
+		freq = "updatefrequency:" + strconv.Itoa(int(c.UpdateFrequency/time.Second))
+	}
+	content := "#上级NTP服务器的IP地址或主机名 不填写表示本地时钟\n" +
+		"#可带端口，IPv6地址带端口时加方括号；多个服务器用逗号分隔，参与时钟选择\n" +
+		server + "\n" +
+		fmt.Sprintf("#更新频率 秒  默认%d  若本地时间不填写无意义\n", DefaultPeerPoll/time.Second) +
+		freq + "\n" +
+		"#配置文件结束\n"
+	return os.WriteFile(c.Path, []byte(content), 0644)
+}
+
+// PromptServerConfig asks on a terminal for the values missing from cfg and
+// offers to save what was entered. When nothing is typed for timeout the
+// prompt gives up and the server starts with the values it has.
+func PromptServerConfig(cfg *ServerConfig, in io.Reader, out io.Writer, timeout time.Duration) {
+	if cfg.NtpServerIP != "" && cfg.UpdateFrequency > 0 {
+		return
+	}
+	// 超时返回后读取stdin的goroutine仍阻塞在Scan上；再读到的一行放入缓冲，
+	// 之后看到done就退出，不会永远阻塞在发送上
+	lines := make(chan string, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			select {
+			case lines <- strings.TrimSpace(scanner.Text()):
+			case <-done:
+				return
+			}
+		}
+	}()
+	ask := func(question string) (string, bool) {
+		fmt.Fprintf(out, "%s（%v内无操作自动继续）: ", question, timeout)
+		select {
+		case line, ok := <-lines:
+			return line, ok
+		case <-time.After(timeout):
+			fmt.Fprintln(out, "\n超时，使用当前配置继续启动")
+			return "", false
+		}
+	}
+
+	fmt.Fprintf(out, "%s 中缺少配置，可在此输入；如需长期保存请修改该配置文件\n", cfg.Path)
+	changed := false
+	if cfg.NtpServerIP == "" {
+		ip, ok := ask("上级NTP服务器IP地址，直接回车表示使用本地时钟")
+		if !ok {
+			return
+		}
+		if ip != "" {
+			cfg.NtpServerIP, changed = ip, true
+		}
+	}
+	if cfg.NtpServerIP != "" && cfg.UpdateFrequency <= 0 {
+		for {
+			value, ok := ask(fmt.Sprintf("更新频率（秒），直接回车使用默认值%d", DefaultPeerPoll/time.Second))
+			if !ok {
+				return
+			}
+			if value == "" {
+				break
+			}
+			secs, err := strconv.Atoi(value)
+			if err == nil && secs > 0 {
+				cfg.UpdateFrequency, changed = time.Duration(secs)*time.Second, true
+				break
+			}
+			fmt.Fprintln(out, "请输入正整数")
+		}
+	}
+	if !changed {
+		return
+	}
+	answer, ok := ask(fmt.Sprintf("是否保存到 %s? [y/N]", cfg.Path))
+	if !ok || !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+		return
+	}
+	if err := cfg.Save(); err != nil {
+		fmt.Fprintln(out, "保存配置失败:", err)
+		return
+	}
+	fmt.Fprintln(out, "配置已保存到", cfg.Path)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseServerConfig(t *testing.T) {
+	cfg, err := ParseServerConfig(strings.NewReader(`#上级NTP服务器
+  # indented comment
+
+NtpServerIP : 10.10.10.10:123, [2001:db8::1]:123,2001:db8::2,ntp.example.com
+updatefrequency:3600
+futuresetting:1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UpdateFrequency != time.Hour {
+		t.Errorf("updatefrequency %v, want 1h", cfg.UpdateFrequency)
+	}
+	// 值只按第一个冒号分割，端口和IPv6地址原样交给resolveNtpAddr
+	want := []string{"10.10.10.10:123", "[2001:db8::1]:123", "2001:db8::2", "ntp.example.com"}
+	servers := strings.Split(cfg.NtpServerIP, ",")
+	if len(servers) != len(want) {
+		t.Fatalf("ntpserverip %q, want %q", cfg.NtpServerIP, want)
+	}
+	for i, s := range servers {
+		if s = strings.TrimSpace(s); s != want[i] {
+			t.Errorf("server %d: %q, want %q", i, s, want[i])
+		}
+	}
+
+	addrs := []struct {
+		in   string
+		want *net.UDPAddr
+	}{
+		{"10.10.10.10:123", &net.UDPAddr{IP: net.IPv4(10, 10, 10, 10), Port: 123}},
+		{"10.10.10.10:1123", &net.UDPAddr{IP: net.IPv4(10, 10, 10, 10), Port: 1123}},
+		{"10.10.10.10", &net.UDPAddr{IP: net.IPv4(10, 10, 10, 10), Port: 123}},
+		{"[2001:db8::1]:1123", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1123}},
+		{"2001:db8::2", &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 123}},
+	}
+	for _, tt := range addrs {
+		addr, err := resolveNtpAddr(tt.in)
+		if err != nil || !addr.IP.Equal(tt.want.IP) || addr.Port != tt.want.Port {
+			t.Errorf("%s: %v %v, want %v", tt.in, addr, err, tt.want)
+		}
+	}
+}
+
+func TestParseServerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"no colon", "ntpserverip 10.10.10.10"},
+		{"frequency not a number", "updatefrequency:hourly"},
+		{"frequency zero", "updatefrequency:0"},
+		{"frequency negative", "updatefrequency:-60"},
+	}
+	for _, tt := range tests {
+		_, err := ParseServerConfig(strings.NewReader("# comment\n" + tt.line + "\n"))
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%s: err %v, want one naming line 2", tt.name, err)
+		}
+	}
+}
+
+// TestShippedServerConfig checks that the ntpserver.conf in the repository
+// leaves every value unset, and that Save writes a file that loads back.
+func TestShippedServerConfig(t *testing.T) {
+	cfg, err := LoadServerConfig(DefaultConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NtpServerIP != "" || cfg.UpdateFrequency != 0 {
+		t.Errorf("shipped config sets %q %v", cfg.NtpServerIP, cfg.UpdateFrequency)
+	}
+
+	for _, saved := range []ServerConfig{
+		{NtpServerIP: "10.10.10.10,[2001:db8::1]:123", UpdateFrequency: time.Hour},
+		{NtpServerIP: "10.10.10.10"},
+	} {
+		saved.Path = filepath.Join(t.TempDir(), DefaultConfigFile)
+		if err := saved.Save(); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadServerConfig(saved.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *loaded != saved {
+			t.Errorf("saved %+v, loaded %+v", saved, *loaded)
+		}
+	}
+}
+
+func TestPromptServerConfig(t *testing.T) {
+	cfg := &ServerConfig{Path: filepath.Join(t.TempDir(), DefaultConfigFile)}
+	var out bytes.Buffer
+	PromptServerConfig(cfg, strings.NewReader("10.10.10.10\nsoon\n600\ny\n"), &out, time.Second)
+	if cfg.NtpServerIP != "10.10.10.10" || cfg.UpdateFrequency != 10*time.Minute {
+		t.Errorf("prompted config %+v", cfg)
+	}
+	if loaded, err := LoadServerConfig(cfg.Path); err != nil || *loaded != *cfg {
+		t.Errorf("saved config %+v %v, want %+v", loaded, err, cfg)
+	}
+
+	// 无人输入时超时返回，使用已有的值继续启动
+	r, w := io.Pipe()
+	defer w.Close()
+	cfg = &ServerConfig{Path: filepath.Join(t.TempDir(), DefaultConfigFile)}
+	start := time.Now()
+	PromptServerConfig(cfg, r, io.Discard, 50*time.Millisecond)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("prompt returned after %v", d)
+	}
+	if cfg.NtpServerIP != "" {
+		t.Errorf("timed out prompt set %q", cfg.NtpServerIP)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Mode 6 control message opcodes (RFC 9327 2)
+const (
+	ctlOpReadStatus uint8 = 1 //READSTAT 读取关联列表/状态
+	ctlOpReadVars   uint8 = 2 //READVAR 读取系统或对端变量
+)
+
+// Mode 6 error codes, carried in the high byte of Status when E is set
+const (
+	ctlErrUnspec     uint16 = 0 //未指明
+	ctlErrBadFormat  uint16 = 2 //报文格式错误
+	ctlErrBadOpcode  uint16 = 3 //不支持的操作码
+	ctlErrBadAssoc   uint16 = 4 //关联ID不存在
+	ctlErrUnknownVar uint16 = 5 //变量名不存在
+)
+
+const (
+	ctlHeaderLength = 12
+	ctlMaxData      = 468 //每个分片最多468字节数据
+	ctlMaxFragments = 4   //一个应答最多4个分片，限制应答相对请求的放大倍数
+	ctlLineLength   = 72  //变量列表按ntpd的习惯每行不超过72字符
+
+	ctlResponseBit = 0x80
+	ctlErrorBit    = 0x40
+	ctlMoreBit     = 0x20
+	ctlOpcodeMask  = 0x1f
+
+	ctlSourceLocal = 5 //系统状态字时钟源：本地时钟
+	ctlSourceNTP   = 6 //系统状态字时钟源：NTP
+
+	ctlPeerConfigured = 0x80 //对端状态字：配置的关联
+	ctlPeerAuthEnable = 0x40 //对端状态字：启用认证
+	ctlPeerAuthentic  = 0x20 //对端状态字：认证通过
+	ctlPeerReachable  = 0x10 //对端状态字：可达
+)
+
+// ControlServer answers NTP mode 6 control messages as used by ntpq: the
+// association list (READSTAT) and the system and peer variables (READVAR).
+// Writes are not supported. Requests are only answered for addresses in
+// Allow, and a response never exceeds ctlMaxFragments fragments, so the
+// server cannot be used to amplify traffic towards a spoofed address.
+type ControlServer struct {
+	Service *NTPService
+	Assocs  *AssociationManager
+	Allow   []*net.IPNet //允许查询的网段，nil表示只允许本机
+}
+
+type ctlHeader struct {
+	version uint8
+	opcode  uint8
+	seq     uint16
+	assoc   uint16
+}
+
+type ctlVar struct {
+	name  string
+	value string
+}
+
+// HandlePacket answers the mode 6 request in buf.
+func (c *ControlServer) HandlePacket(buf []byte, conn *net.UDPConn, addr *net.UDPAddr, recvTime time.Time) {
+	if c.Allow == nil && !addr.IP.IsLoopback() || c.Allow != nil && !containsIP(c.Allow, addr.IP) {
+		return //与ntpd的noquery一样静默丢弃
+	}
+	if len(buf) < ctlHeaderLength || buf[1]&ctlResponseBit != 0 {
+		return //不应答应答报文，避免两台服务器互相反射
+	}
+	hdr := ctlHeader{
+		version: buf[0] >> 3 & 0x07,
+		opcode:  buf[1] & ctlOpcodeMask,
+		seq:     binary.BigEndian.Uint16(buf[2:4]),
+		assoc:   binary.BigEndian.Uint16(buf[6:8]),
+	}
+	offset := binary.BigEndian.Uint16(buf[8:10])
+	count := int(binary.BigEndian.Uint16(buf[10:12]))
+	if hdr.version < minNtpVersion || hdr.version > maxNtpVersion || offset != 0 || count > len(buf)-ctlHeaderLength {
+		c.sendError(conn, addr, hdr, ctlErrBadFormat)
+		return
+	}
+	names := parseCtlNames(buf[ctlHeaderLength : ctlHeaderLength+count])
+
+	switch hdr.opcode {
+	case ctlOpReadStatus:
+		if hdr.assoc == 0 {
+			var data []byte
+			for _, a := range c.associations() {
+				status := a.controlStatus()
+				data = append(data, byte(a.ID>>8), byte(a.ID), byte(status>>8), byte(status))
+			}
+			c.send(conn, addr, hdr, c.systemStatus(recvTime), data)
+			return
+		}
+		fallthrough //单个关联的READSTAT与READVAR相同
+	case ctlOpReadVars:
+		var vars []ctlVar
+		status := c.systemStatus(recvTime)
+		if hdr.assoc == 0 {
+			vars = c.systemVars(recvTime)
+			if len(names) > 0 {
+				vars = append(vars, c.statsVars(recvTime)...) //统计变量只按名称读取 如ntpq -c sysstats
+			}
+		} else {
+			a, ok := c.association(hdr.assoc)
+			if !ok {
+				c.sendError(conn, addr, hdr, ctlErrBadAssoc)
+				return
+			}
+			vars, status = c.peerVars(&a), a.controlStatus()
+		}
+		vars, ok := selectCtlVars(vars, names)
+		if !ok {
+			c.sendError(conn, addr, hdr, ctlErrUnknownVar)
+			return
+		}
+		c.send(conn, addr, hdr, status, formatCtlVars(vars))
+	default:
+		c.sendError(conn, addr, hdr, ctlErrBadOpcode)
+	}
+}
+
+func (c *ControlServer) associations() []Association {
+	if c.Assocs == nil {
+		return nil
+	}
+	return c.Assocs.Associations()
+}
+
+func (c *ControlServer) association(id uint16) (Association, bool) {
+	for _, a := range c.associations() {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return Association{}, false
+}
+
+// systemStatus returns the system status word: LI, clock source, and an
+// event counter and code that are always zero here.
+func (c *ControlServer) systemStatus(now time.Time) uint16 {
+	source := uint16(ctlSourceLocal)
+	if c.Service.Sync != nil {
+		source = ctlSourceNTP
+	}
+	return uint16(c.Service.SystemVars(now).Leap)<<14 | source<<8
+}
+
+// controlStatus returns the peer status word of an association.
+func (a *Association) controlStatus() uint16 {
+	var status uint16
+	if a.HostMode == ModeSymmetricActive || a.HostMode == ModeClient {
+		status |= ctlPeerConfigured //被动对等体和广播关联是收到报文后建立的
+	}
+	if a.KeyID != 0 {
+		status |= ctlPeerAuthEnable | ctlPeerAuthentic //未通过认证的报文在HandlePacket中已丢弃
+	}
+	if a.Reach != 0 {
+		status |= ctlPeerReachable
+	}
+	status |= uint16(a.Select) & 0x07 //低3位为时钟选择结果，ntpq据此显示 * + - x
+	return status << 8
+}
+
+// systemVars returns the system variables as served in NTP responses.
+func (c *ControlServer) systemVars(now time.Time) []ctlVar {
+	sys := c.Service.SystemVars(now)
+	hdr := newServerPacket(sys).Packet()
+	sysPeer, sysJitter := c.Assocs.SystemPeer()
+	vars := []ctlVar{
+		{"version", fmt.Sprintf("%q", "NTPServer_CreateByChatGPT "+runtime.Version())},
+		{"processor", fmt.Sprintf("%q", runtime.GOARCH)},
+		{"system", fmt.Sprintf("%q", runtime.GOOS)},
+		{"leap", fmt.Sprintf("%02b", hdr.LeapIndicator)},
+		{"stratum", fmt.Sprint(hdr.Stratum)},
+		{"precision", fmt.Sprint(hdr.Precision)},
+		{"rootdelay", ctlMillis(NtpShortToDuration(hdr.RootDelay))},
+		{"rootdisp", ctlMillis(NtpShortToDuration(hdr.RootDisp))},
+		{"refid", ReferenceIDString(hdr.Stratum, hdr.ReferenceID)},
+		{"reftime", ctlTimestamp(hdr.RefTimestamp)},
+		{"clock", ctlTimestamp(NewNtpTimestamp(now))},
+		{"peer", fmt.Sprint(sysPeer)},
+		{"offset", ctlMillis(c.Service.Sync.Offset())},
+		{"sys_jitter", ctlMillis(sysJitter)},
+	}
+	if c.Service.Leap != nil {
+		vars = append(vars, ctlVar{"tai", fmt.Sprint(c.Service.Leap.TAIOffset(now))})
+		if next, _, ok := c.Service.Leap.NextLeap(now); ok {
+			vars = append(vars, ctlVar{"leapsec", next.At.Format("200601021504")})
+		}
+		vars = append(vars, ctlVar{"expire", c.Service.Leap.Expires.Format("200601021504")})
+	}
+	if c.Service.Smear != nil {
+		vars = append(vars,
+			ctlVar{"leapsmearinterval", fmt.Sprint(int64(c.Service.Smear.Window / time.Second))},
+			ctlVar{"leapsmearoffset", ctlMillis(c.Service.SmearOffset())})
+	}
+	return vars
+}
+
+// statsVars returns the request counters, using ntpd's sysstats names
+// plus one ss_vN counter per NTP version.
+func (c *ControlServer) statsVars(now time.Time) []ctlVar {
+	st := c.Service.Stats
+	var uptime time.Duration
+	if st != nil {
+		uptime = now.Sub(st.Started)
+	}
+	vars := []ctlVar{
+		{"ss_uptime", fmt.Sprint(int64(uptime / time.Second))},
+		{"ss_received", fmt.Sprint(st.Total())},
+		{"ss_thisver", fmt.Sprint(st.Requests(maxNtpVersion))},
+		{"ss_oldver", fmt.Sprint(st.Total() - st.Requests(maxNtpVersion))},
+	}
+	for v := minNtpVersion; v <= maxNtpVersion; v++ {
+		vars = append(vars, ctlVar{fmt.Sprintf("ss_v%d", v), fmt.Sprint(st.Requests(v))})
+	}
+	return vars
+}
+
+// peerVars returns the variables of one association, named as ntpd does so
+// that "ntpq -p" can print them.
+func (c *ControlServer) peerVars(a *Association) []ctlVar {
+	dstadr, dstport := "0.0.0.0", "123"
+	if c.Assocs.Conn != nil {
+		if local, ok := c.Assocs.Conn.LocalAddr().(*net.UDPAddr); ok {
+			dstadr, dstport = local.IP.String(), fmt.Sprint(local.Port)
+		}
+	}
+	refid := ReferenceIDString(a.Stratum, a.RefID)
+	if a.Stratum == 0 && a.RefID == 0 {
+		refid = ".INIT." //尚未收到对端报文
+	}
+	return []ctlVar{
+		{"srcadr", a.Addr.IP.String()},
+		{"srcport", fmt.Sprint(a.Addr.Port)},
+		{"dstadr", dstadr},
+		{"dstport", dstport},
+		{"leap", fmt.Sprintf("%02b", a.Leap)},
+		{"stratum", fmt.Sprint(a.Stratum)},
+		{"precision", fmt.Sprint(a.Precision)},
+		{"rootdelay", ctlMillis(a.RootDelay)},
+		{"rootdisp", ctlMillis(a.RootDisp)},
+		{"refid", refid},
+		{"reftime", ctlTimestamp(a.RefTime)},
+		{"rec", ctlTimestamp(a.rec)},
+		{"reach", fmt.Sprintf("%03o", a.Reach)},
+		{"hmode", fmt.Sprint(a.HostMode)},
+		{"hpoll", fmt.Sprint(pollExponent(a.Poll))},
+		{"ppoll", fmt.Sprint(pollExponent(a.Poll))},
+		{"keyid", fmt.Sprint(a.KeyID)},
+		{"offset", ctlMillis(a.Offset)},
+		{"delay", ctlMillis(a.Delay)},
+		{"dispersion", ctlMillis(a.Dispersion)},
+		{"jitter", ctlMillis(a.Jitter)},
+		{"select", a.Select.String()},
+	}
+}
+
+// parseCtlNames splits a READVAR request body into variable names.
+func parseCtlNames(data []byte) []string {
+	var names []string
+	for _, item := range strings.Split(string(data), ",") {
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			item = item[:i]
+		}
+		if item = strings.TrimSpace(strings.Trim(item, "\x00")); item != "" {
+			names = append(names, item)
+		}
+	}
+	return names
+}
+
+// selectCtlVars returns the requested variables in request order, or all
+// of them when none are named. Like ntpd it skips names it does not know,
+// since ntpq asks for variables only some servers have, and only fails
+// when none of the names match.
+func selectCtlVars(vars []ctlVar, names []string) ([]ctlVar, bool) {
+	if len(names) == 0 {
+		return vars, true
+	}
+	selected := make([]ctlVar, 0, len(names))
+	for _, name := range names {
+		for _, v := range vars {
+			if v.name == name {
+				selected = append(selected, v)
+				break
+			}
+		}
+	}
+	return selected, len(selected) > 0
+}
+
+// formatCtlVars renders "name=value" pairs separated by ", " with a line
+// break whenever a line would exceed ctlLineLength.
+func formatCtlVars(vars []ctlVar) []byte {
+	var b strings.Builder
+	lineLen := 0
+	for i, v := range vars {
+		item := v.name + "=" + v.value
+		if i > 0 {
+			if lineLen+2+len(item) > ctlLineLength {
+				b.WriteString(",\r\n")
+				lineLen = 0
+			} else {
+				b.WriteString(", ")
+				lineLen += 2
+			}
+		}
+		b.WriteString(item)
+		lineLen += len(item)
+	}
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+func ctlMillis(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+func ctlTimestamp(ts NtpTimestamp) string {
+	return fmt.Sprintf("0x%08x.%08x", ts.Seconds(), ts.Fraction())
+}
+
+// send writes data as one or more fragments of at most ctlMaxData bytes.
+func (c *ControlServer) send(conn *net.UDPConn, addr *net.UDPAddr, hdr ctlHeader, status uint16, data []byte) {
+	if len(data) > ctlMaxData*ctlMaxFragments {
+		c.Service.debugln("Mode 6 response to", addr, "too large:", len(data), "bytes")
+		c.sendError(conn, addr, hdr, ctlErrUnspec)
+		return
+	}
+	offset := 0
+	for {
+		chunk := data[offset:]
+		more := false
+		if len(chunk) > ctlMaxData {
+			chunk, more = chunk[:ctlMaxData], true
+		}
+		flags := uint8(ctlResponseBit)
+		if more {
+			flags |= ctlMoreBit
+		}
+		pkt := ctlPacket(hdr, flags, status, uint16(offset), chunk)
+		if _, err := conn.WriteToUDP(pkt, addr); err != nil {
+			fmt.Println("Error sending mode 6 response:", err)
+			return
+		}
+		if !more {
+			return
+		}
+		offset += len(chunk)
+	}
+}
+
+func (c *ControlServer) sendError(conn *net.UDPConn, addr *net.UDPAddr, hdr ctlHeader, code uint16) {
+	pkt := ctlPacket(hdr, ctlResponseBit|ctlErrorBit, code<<8, 0, nil)
+	if _, err := conn.WriteToUDP(pkt, addr); err != nil {
+		fmt.Println("Error sending mode 6 error:", err)
+	}
+}
+
+// ctlPacket encodes one control message, padding the data to 32 bits.
+func ctlPacket(hdr ctlHeader, flags uint8, status, offset uint16, data []byte) []byte {
+	pkt := make([]byte, ctlHeaderLength, ctlHeaderLength+len(data)+3)
+	pkt[0] = hdr.version<<3 | ModeControl
+	pkt[1] = flags | hdr.opcode
+	binary.BigEndian.PutUint16(pkt[2:4], hdr.seq)
+	binary.BigEndian.PutUint16(pkt[4:6], status)
+	binary.BigEndian.PutUint16(pkt[6:8], hdr.assoc)
+	binary.BigEndian.PutUint16(pkt[8:10], offset)
+	binary.BigEndian.PutUint16(pkt[10:12], uint16(len(data)))
+	pkt = append(pkt, data...)
+	for len(pkt)%4 != 0 {
+		pkt = append(pkt, 0)
+	}
+	return pkt
+}
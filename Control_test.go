@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ntpq 4.2.8 requests, version 2 mode 6: "rv" and the association list
+// and peer variables of "-p" for association 1.
+const (
+	ntpqReadVarSystem = "160200010000000000000000"
+	ntpqReadStat      = "160100020000000000000000"
+	ntpqPeerHeader    = "1602000300000001000000"
+	ntpqPeerVars      = "srcadr,srcport,srchost,dstadr,dstport,leap,stratum,precision,rootdelay,rootdisp," +
+		"refid,reftime,rec,reach,unreach,hmode,pmode,hpoll,ppoll,headway,flash,keyid,offset,delay,dispersion,jitter"
+)
+
+type ctlResponse struct {
+	flags  uint8
+	seq    uint16
+	status uint16
+	assoc  uint16
+	offset uint16
+	data   []byte
+}
+
+// ctlPair returns a socket the control server answers on and the client
+// socket its requests come from, both on 127.0.0.1.
+func ctlPair(t *testing.T) (server, client *net.UDPConn) {
+	t.Helper()
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	return listen(), listen()
+}
+
+// ctlExchange passes req to c as if it came from client and returns every
+// fragment sent back.
+func ctlExchange(t *testing.T, c *ControlServer, req []byte) []ctlResponse {
+	t.Helper()
+	server, client := ctlPair(t)
+	c.HandlePacket(req, server, client.LocalAddr().(*net.UDPAddr), time.Now())
+	return readCtl(t, client)
+}
+
+func readCtl(t *testing.T, conn *net.UDPConn) []ctlResponse {
+	t.Helper()
+	var frags []ctlResponse
+	buf := make([]byte, MaxPacketSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return frags
+		}
+		if n < ctlHeaderLength || n%4 != 0 || buf[0]&0x07 != ModeControl {
+			t.Fatalf("malformed response % x", buf[:n])
+		}
+		count := int(binary.BigEndian.Uint16(buf[10:12]))
+		frags = append(frags, ctlResponse{
+			flags:  buf[1],
+			seq:    binary.BigEndian.Uint16(buf[2:4]),
+			status: binary.BigEndian.Uint16(buf[4:6]),
+			assoc:  binary.BigEndian.Uint16(buf[6:8]),
+			offset: binary.BigEndian.Uint16(buf[8:10]),
+			data:   append([]byte(nil), buf[ctlHeaderLength:ctlHeaderLength+count]...),
+		})
+	}
+}
+
+func ntpqRequest(t *testing.T, header, body string) []byte {
+	t.Helper()
+	req, err := hex.DecodeString(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req) == ctlHeaderLength-1 {
+		req = append(req, byte(len(body))) //count的低字节
+	}
+	req = append(req, body...)
+	for len(req)%4 != 0 {
+		req = append(req, 0)
+	}
+	return req
+}
+
+func newTestControl(t *testing.T) *ControlServer {
+	m, server, _ := newTestManager(t)
+	feed(server, 1, refIDFromCode("GPS"), 20*time.Millisecond, time.Now())
+	m.selectSources(time.Now())
+	return &ControlServer{Service: m.Service, Assocs: m}
+}
+
+func TestControlNtpqRequests(t *testing.T) {
+	c := newTestControl(t)
+
+	frags := ctlExchange(t, c, ntpqRequest(t, ntpqReadStat, ""))
+	if len(frags) != 1 || frags[0].flags != ctlResponseBit|ctlOpReadStatus || frags[0].seq != 2 {
+		t.Fatalf("READSTAT: %+v", frags)
+	}
+	data := frags[0].data
+	if len(data) != 8 {
+		t.Fatalf("READSTAT data % x, want two associations", data)
+	}
+	if id, status := binary.BigEndian.Uint16(data[0:]), data[2]; id != 1 || status&0x07 != uint8(SelectSystemPeer) || status&ctlPeerConfigured == 0 {
+		t.Errorf("association %d status %#02x, want 1 configured and selected", id, status)
+	}
+
+	frags = ctlExchange(t, c, ntpqRequest(t, ntpqReadVarSystem, ""))
+	if len(frags) != 1 || frags[0].flags&ctlErrorBit != 0 {
+		t.Fatalf("rv: %+v", frags)
+	}
+	rv := string(frags[0].data)
+	for _, want := range []string{"stratum=2", "refid=192.0.2.1", "peer=1"} {
+		if !strings.Contains(rv, want) {
+			t.Errorf("rv %q lacks %s", rv, want)
+		}
+	}
+
+	// ntpq -p 请求的变量中有本服务器没有的 srchost unreach pmode headway flash，跳过即可
+	frags = ctlExchange(t, c, ntpqRequest(t, ntpqPeerHeader, ntpqPeerVars))
+	if len(frags) != 1 || frags[0].flags&ctlErrorBit != 0 || frags[0].assoc != 1 {
+		t.Fatalf("peer READVAR: %+v", frags)
+	}
+	peer := string(frags[0].data)
+	for _, want := range []string{"srcadr=192.0.2.1", "hmode=3", "refid=.GPS.", "stratum=1", "reach=001"} {
+		if !strings.Contains(peer, want) {
+			t.Errorf("peer variables %q lack %s", peer, want)
+		}
+	}
+	if strings.Contains(peer, "srchost") || strings.Contains(peer, "flash") {
+		t.Errorf("peer variables %q contain unknown names", peer)
+	}
+}
+
+func TestControlErrors(t *testing.T) {
+	c := newTestControl(t)
+	tests := []struct {
+		name string
+		req  []byte
+		code uint16
+	}{
+		{"only unknown variables", ntpqRequest(t, ntpqPeerHeader, "srchost,flash"), ctlErrUnknownVar},
+		{"unknown association", ntpqRequest(t, "1602000400000009000000", "offset"), ctlErrBadAssoc},
+		{"unknown opcode", ntpqRequest(t, "1608000500000000000000", ""), ctlErrBadOpcode},
+		{"count beyond packet", ntpqRequest(t, "16020006000000000000ff", ""), ctlErrBadFormat},
+		{"non-zero offset", ntpqRequest(t, "1602000700000000000400", ""), ctlErrBadFormat},
+	}
+	for _, tt := range tests {
+		frags := ctlExchange(t, c, tt.req)
+		if len(frags) != 1 || frags[0].flags&ctlErrorBit == 0 || frags[0].status>>8 != tt.code {
+			t.Errorf("%s: %+v, want error %d", tt.name, frags, tt.code)
+		}
+	}
+
+	resp := ntpqRequest(t, ntpqReadVarSystem, "")
+	resp[1] |= ctlResponseBit
+	if frags := ctlExchange(t, c, resp); len(frags) != 0 {
+		t.Errorf("answered a response: %+v", frags)
+	}
+	c.Allow = []*net.IPNet{{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)}}
+	if frags := ctlExchange(t, c, ntpqRequest(t, ntpqReadVarSystem, "")); len(frags) != 0 {
+		t.Errorf("answered an address outside Allow: %+v", frags)
+	}
+}
+
+// TestControlFragments checks that the largest allowed response goes out
+// as ctlMaxFragments fragments and that anything larger is refused.
+func TestControlFragments(t *testing.T) {
+	c := newTestControl(t)
+	hdr := ctlHeader{version: 2, opcode: ctlOpReadVars, seq: 9}
+	data := bytes.Repeat([]byte("x"), ctlMaxData*ctlMaxFragments)
+	server, client := ctlPair(t)
+	c.send(server, client.LocalAddr().(*net.UDPAddr), hdr, 0, data)
+	frags := readCtl(t, client)
+	if len(frags) != ctlMaxFragments {
+		t.Fatalf("%d fragments, want %d", len(frags), ctlMaxFragments)
+	}
+	var joined []byte
+	for i, f := range frags {
+		more := f.flags&ctlMoreBit != 0
+		if more != (i < ctlMaxFragments-1) || int(f.offset) != i*ctlMaxData || len(f.data) != ctlMaxData || f.seq != 9 {
+			t.Errorf("fragment %d: more %v offset %d length %d seq %d", i, more, f.offset, len(f.data), f.seq)
+		}
+		joined = append(joined, f.data...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Error("fragments do not reassemble to the data")
+	}
+
+	c.send(server, client.LocalAddr().(*net.UDPAddr), hdr, 0, append(data, 'x'))
+	frags = readCtl(t, client)
+	if len(frags) != 1 || frags[0].flags&ctlErrorBit == 0 {
+		t.Errorf("oversized response: %+v, want one error", frags)
+	}
+}
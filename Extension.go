@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	extFieldHeaderLength = 4      //Field Type 16bit + Length 16bit
+	minExtFieldLength    = 16     //RFC 7822 7.5 扩展字段最短16字节
+	minLastExtNoMAC      = 28     //无MAC时最后一个扩展字段至少28字节，避免与MAC混淆
+	maxExtFieldLength    = 0xfffc //Length字段16bit且须4字节对齐
+	maxMACTrailerLength  = 24     //Key ID 4字节 + SHA1摘要20字节
+	cryptoNAKLength      = 4      //crypto-NAK只有Key ID=0
+)
+
+// ErrBadExtension is returned for extension fields whose length is not a
+// multiple of four, is below the RFC 7822 minimum, or runs past the packet,
+// and when encoding a value too long for the 16-bit Length field.
+var ErrBadExtension = errors.New("ntp: malformed extension field")
+
+// ExtensionField is an RFC 7822 extension field. Value holds the field body
+// as carried on the wire, including any padding.
+type ExtensionField struct {
+	Type  uint16 //Field Type
+	Value []byte //Value 不含4字节头部
+}
+
+// MACTrailer is the optional Key Identifier / Message Digest trailer of an
+// NTP packet. An empty Digest with KeyID 0 is a crypto-NAK.
+type MACTrailer struct {
+	KeyID  uint32 //Key Identifier：32bit
+	Digest []byte //Message Digest：MD5 16字节 / SHA1 20字节 / AES-CMAC 16字节
+}
+
+// IsCryptoNAK reports whether the trailer is a crypto-NAK (RFC 5905 7.4).
+func (m *MACTrailer) IsCryptoNAK() bool {
+	return m != nil && m.KeyID == 0 && len(m.Digest) == 0
+}
+
+func isMACTrailerLength(n int) bool {
+	return n == cryptoNAKLength || n == 4+16 || n == 4+20
+}
+
+// parseTrailer splits everything after the 48-byte header into extension
+// fields and an optional MAC, following the RFC 7822 7.5 rules. Versions
+// before 4 have no extension fields, so their trailer can only be a MAC.
+func parseTrailer(version uint8, trailer []byte) ([]ExtensionField, *MACTrailer, error) {
+	var exts []ExtensionField
+	if version == 4 {
+		for len(trailer) > maxMACTrailerLength || (len(trailer) > 0 && !isMACTrailerLength(len(trailer))) {
+			if len(trailer) < minExtFieldLength {
+				return nil, nil, ErrBadExtension
+			}
+			length := int(binary.BigEndian.Uint16(trailer[2:4]))
+			if length < minExtFieldLength || length%4 != 0 || length > len(trailer) {
+				return nil, nil, ErrBadExtension
+			}
+			exts = append(exts, ExtensionField{
+				Type:  binary.BigEndian.Uint16(trailer[0:2]),
+				Value: append([]byte(nil), trailer[extFieldHeaderLength:length]...),
+			})
+			trailer = trailer[length:]
+		}
+	}
+	if len(trailer) == 0 {
+		return exts, nil, nil
+	}
+	if !isMACTrailerLength(len(trailer)) {
+		return nil, nil, fmt.Errorf("ntp: invalid MAC length %d", len(trailer))
+	}
+	return exts, &MACTrailer{
+		KeyID:  binary.BigEndian.Uint32(trailer[0:4]),
+		Digest: append([]byte(nil), trailer[4:]...),
+	}, nil
+}
+
+// appendExtensions encodes exts, padding each field to a multiple of four
+// and to the RFC 7822 minimum length.
+func appendExtensions(buf []byte, exts []ExtensionField, hasMAC bool) []byte {
+	for i, ext := range exts {
+		length := extFieldHeaderLength + len(ext.Value)
+		minLength := minExtFieldLength
+		if i == len(exts)-1 && !hasMAC {
+			minLength = minLastExtNoMAC
+		}
+		if length < minLength {
+			length = minLength
+		}
+		length = (length + 3) &^ 3
+		field := make([]byte, length)
+		binary.BigEndian.PutUint16(field[0:2], ext.Type)
+		binary.BigEndian.PutUint16(field[2:4], uint16(length))
+		copy(field[extFieldHeaderLength:], ext.Value)
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+func appendMAC(buf []byte, mac *MACTrailer) []byte {
+	if mac == nil {
+		return buf
+	}
+	var keyID [4]byte
+	binary.BigEndian.PutUint32(keyID[:], mac.KeyID)
+	buf = append(buf, keyID[:]...)
+	return append(buf, mac.Digest...)
+}
+
+// Extension returns the first extension field of the given type.
+func (pkt *NTPv4Packet) Extension(typ uint16) (ExtensionField, bool) {
+	for _, ext := range pkt.Extensions {
+		if ext.Type == typ {
+			return ext, true
+		}
+	}
+	return ExtensionField{}, false
+}
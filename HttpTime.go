@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const DefaultHTTPTimeAddr = ":8123"
+
+// HTTPTimeServer serves the current time over HTTP for clients that cannot
+// reach UDP/123, either as JSON or through the Date header that htpdate
+// reads. The time comes from the same NTPService as NTP responses and is
+// taken just before the response is written.
+type HTTPTimeServer struct {
+	Service *NTPService
+	Policy  *AccessPolicy
+	Addr    string //监听地址 默认 ":8123"
+}
+
+// httpTimeResponse is the JSON body.
+type httpTimeResponse struct {
+	UnixNano int64   `json:"unix_nano"`
+	RFC3339  string  `json:"rfc3339"`
+	Leap     string  `json:"leap"`
+	Stratum  uint8   `json:"stratum"`
+	Error    float64 `json:"estimated_error"` //秒，最大误差估计
+}
+
+// ListenAndServe serves HTTP until the listener fails.
+func (s *HTTPTimeServer) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultHTTPTimeAddr
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Listening for HTTP time requests on", ln.Addr())
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	return srv.Serve(ln)
+}
+
+// ServeHTTP answers GET and HEAD. Requests refused by the access policy get
+// 429 for rate limiting and 403 otherwise; while unsynchronised the time is
+// still returned, with status 503 and leap "unsync".
+func (s *HTTPTimeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	switch s.Policy.Decide(net.ParseIP(host), s.Service.Now()) {
+	case PolicyServe:
+	case PolicyKissRate:
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+		return
+	default:
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	now := s.Service.Now() //尽量靠近写出应答的时刻取时间
+	sys := s.Service.SystemVars(now)
+	body, err := json.Marshal(httpTimeResponse{
+		UnixNano: now.UnixNano(),
+		RFC3339:  now.UTC().Format(time.RFC3339Nano),
+		Leap:     leapNames[sys.Leap&3],
+		Stratum:  sys.Stratum,
+		Error:    sys.RootDistance().Seconds(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	// 显式设置Date，否则net/http会用未同步的系统时钟填写
+	h.Set("Date", now.UTC().Format(http.TimeFormat))
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "no-store")
+	status := http.StatusOK
+	if sys.Leap == LeapNotInSync {
+		status = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
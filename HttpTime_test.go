@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// httpTimeGet passes one request from 192.0.2.1 to s and returns the
+// recorded response.
+func httpTimeGet(s *HTTPTimeServer, method string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/", nil)
+	req.RemoteAddr = "192.0.2.1:40000"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestHTTPTimeServed checks that the body and the Date header carry the
+// served time, clock plus the offset from the upstream server, rather than
+// the system clock.
+func TestHTTPTimeServed(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2020, 5, 1, 12, 0, 0, 250e6, time.UTC)}
+	ntp := &NTPService{Clock: clock, Sync: &SyncState{}}
+	ntp.Sync.Set(SyncUpdate{
+		Offset:    90 * time.Minute,
+		Source:    net.IPv4(192, 0, 2, 123),
+		Stratum:   1,
+		RootDelay: 20 * time.Millisecond,
+		RootDisp:  5 * time.Millisecond,
+	}, clock.Now())
+	served := clock.t.Add(90 * time.Minute)
+
+	rec := httpTimeGet(&HTTPTimeServer{Service: ntp}, http.MethodGet)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	if date := rec.Header().Get("Date"); date != "Fri, 01 May 2020 13:30:00 GMT" {
+		t.Errorf("Date %q, want the served time", date)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	var body httpTimeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.UnixNano != served.UnixNano() || body.RFC3339 != "2020-05-01T13:30:00.25Z" {
+		t.Errorf("time %d %s, want %d %s", body.UnixNano, body.RFC3339, served.UnixNano(), served.Format(time.RFC3339Nano))
+	}
+	if body.Leap != "none" || body.Stratum != 2 {
+		t.Errorf("leap %q stratum %d, want none 2", body.Leap, body.Stratum)
+	}
+	if want := ntp.SystemVars(served).RootDistance().Seconds(); body.Error != want || body.Error < 0.01 {
+		t.Errorf("estimated_error %v, want %v", body.Error, want)
+	}
+}
+
+func TestHTTPTimeUnsynchronised(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)}
+	rec := httpTimeGet(&HTTPTimeServer{Service: &NTPService{Clock: clock, Sync: &SyncState{}}}, http.MethodGet)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rec.Code)
+	}
+	var body httpTimeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Leap != "unsync" || body.UnixNano != clock.t.UnixNano() {
+		t.Errorf("leap %q time %d, want unsync and the local clock", body.Leap, body.UnixNano)
+	}
+}
+
+func TestHTTPTimeRefused(t *testing.T) {
+	ntp := &NTPService{}
+	tests := []struct {
+		name   string
+		policy *AccessPolicy
+		method string
+		want   []int
+	}{
+		{"POST", nil, http.MethodPost, []int{http.StatusMethodNotAllowed}},
+		{"HEAD", nil, http.MethodHead, []int{http.StatusOK}},
+		{"rate limited", &AccessPolicy{MinInterval: time.Hour}, http.MethodGet, []int{http.StatusOK, http.StatusTooManyRequests}},
+		{"denied", &AccessPolicy{Deny: []*net.IPNet{{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)}}}, http.MethodGet, []int{http.StatusForbidden}},
+		{"restricted", &AccessPolicy{Restrict: []*net.IPNet{{IP: net.IPv4(192, 0, 2, 1), Mask: net.CIDRMask(32, 32)}}}, http.MethodGet, []int{http.StatusForbidden}},
+	}
+	for _, tt := range tests {
+		s := &HTTPTimeServer{Service: ntp, Policy: tt.policy}
+		for i, want := range tt.want {
+			if rec := httpTimeGet(s, tt.method); rec.Code != want {
+				t.Errorf("%s request %d: status %d, want %d", tt.name, i+1, rec.Code, want)
+			}
+		}
+	}
+	if rec := httpTimeGet(&HTTPTimeServer{Service: ntp}, http.MethodPost); rec.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("405 Allow %q", rec.Header().Get("Allow"))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// DefaultInterleavedClients bounds the interleaved timestamp table.
+const DefaultInterleavedClients = 16384
+
+// InterleavedTable remembers, per client address, the Receive Timestamp of
+// the last response and the time that response actually left the server.
+// A client in interleaved mode (as in ntpd and chrony) echoes that Receive
+// Timestamp in the Origin of its next request and gets the more accurate
+// transmit time of the previous response in return.
+type InterleavedTable struct {
+	Size int //最多记录的客户端数量，0表示DefaultInterleavedClients
+
+	mu      sync.Mutex
+	entries map[string]interleavedEntry
+	order   []string //按插入顺序的客户端，表满时淘汰最早的
+	next    int
+}
+
+type interleavedEntry struct {
+	rx NtpTimestamp //上一个应答中的Receive Timestamp
+	tx NtpTimestamp //上一个应答实际发出的时间
+}
+
+// Match reports whether pkt from ip is an interleaved request and returns
+// the transmit time of the previous response. A request is interleaved when
+// its Origin equals the Receive Timestamp of our previous response and
+// differs from its own Transmit Timestamp.
+func (t *InterleavedTable) Match(ip net.IP, pkt *NTPv4Packet) (NtpTimestamp, bool) {
+	if t == nil || pkt.OrigTimestamp.IsZero() || pkt.OrigTimestamp == pkt.TransmitTimestamp {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[ip.String()]
+	if !ok || e.rx != pkt.OrigTimestamp {
+		return 0, false
+	}
+	return e.tx, true
+}
+
+// Save records the Receive Timestamp and actual transmit time of the
+// response just sent to ip.
+func (t *InterleavedTable) Save(ip net.IP, rx, tx NtpTimestamp) {
+	if t == nil {
+		return
+	}
+	size := t.Size
+	if size <= 0 {
+		size = DefaultInterleavedClients
+	}
+	key := ip.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[string]interleavedEntry)
+		t.order = make([]string, size)
+	}
+	if _, ok := t.entries[key]; !ok {
+		// 环形淘汰：覆盖最早加入的客户端
+		if old := t.order[t.next]; old != "" {
+			delete(t.entries, old)
+		}
+		t.order[t.next] = key
+		t.next = (t.next + 1) % len(t.order)
+	}
+	t.entries[key] = interleavedEntry{rx: rx, tx: tx}
+}
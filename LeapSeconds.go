@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leapFileCheckInterval is how often a running server checks whether the
+// leap seconds file has expired.
+const leapFileCheckInterval = 24 * time.Hour
+
+// ErrLeapHash is returned when the #h line of a leap-seconds.list file does
+// not match the file contents.
+var ErrLeapHash = errors.New("leap-seconds: hash mismatch")
+
+// LeapEntry is one data line of leap-seconds.list: from At on, TAI-UTC is
+// TAIOffset seconds.
+type LeapEntry struct {
+	At        time.Time //生效时刻 即闰秒后新月份的第一秒 UTC
+	TAIOffset int       //TAI-UTC 秒
+}
+
+// LeapTable is a parsed and validated IERS leap-seconds.list.
+type LeapTable struct {
+	Entries []LeapEntry //按时间升序
+	Updated time.Time   //#$ 文件更新时间
+	Expires time.Time   //#@ 文件过期时间，过期后可能缺少新公布的闰秒
+}
+
+// LoadLeapSecondsFile reads and validates a leap-seconds.list file.
+func LoadLeapSecondsFile(path string) (*LeapTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseLeapSeconds(f)
+}
+
+// ParseLeapSeconds parses the IERS/NIST leap-seconds.list format. The SHA-1
+// in the "#h" line covers the update time, the expiry time and the first
+// two fields of every data line, concatenated without whitespace.
+func ParseLeapSeconds(r io.Reader) (*LeapTable, error) {
+	t := &LeapTable{}
+	var updated, expires string
+	var data []string
+	var hashWords []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#$"):
+			updated = strings.TrimSpace(line[2:])
+		case strings.HasPrefix(line, "#@"):
+			expires = strings.TrimSpace(line[2:])
+		case strings.HasPrefix(line, "#h"):
+			hashWords = strings.Fields(line[2:])
+		case strings.HasPrefix(line, "#"), strings.TrimSpace(line) == "":
+		default:
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("leap-seconds: malformed line %q", line)
+			}
+			secs, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("leap-seconds: bad time %q", fields[0])
+			}
+			offset, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("leap-seconds: bad offset %q", fields[1])
+			}
+			t.Entries = append(t.Entries, LeapEntry{At: ntpSecondsToTime(secs), TAIOffset: offset})
+			data = append(data, fields[0], fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if updated == "" || expires == "" || len(hashWords) != 5 {
+		return nil, errors.New("leap-seconds: missing #$, #@ or #h line")
+	}
+	updated, expires = strings.Fields(updated)[0], strings.Fields(expires)[0]
+	var err error
+	if t.Updated, err = parseNtpSeconds(updated); err != nil {
+		return nil, err
+	}
+	if t.Expires, err = parseNtpSeconds(expires); err != nil {
+		return nil, err
+	}
+
+	// 哈希按 更新时间 过期时间 数据行 的顺序计算
+	h := sha1.New()
+	h.Write([]byte(updated + expires + strings.Join(data, "")))
+	digest := h.Sum(nil)
+	for i, w := range hashWords {
+		v, err := strconv.ParseUint(w, 16, 32)
+		if err != nil || uint32(v) != binary.BigEndian.Uint32(digest[i*4:]) {
+			return nil, ErrLeapHash
+		}
+	}
+	if len(t.Entries) == 0 {
+		return nil, errors.New("leap-seconds: no entries")
+	}
+	return t, nil
+}
+
+func parseNtpSeconds(s string) (time.Time, error) {
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("leap-seconds: bad time %q", s)
+	}
+	return ntpSecondsToTime(secs), nil
+}
+
+func ntpSecondsToTime(secs int64) time.Time {
+	return time.Unix(secs-ntpEpochOffset, 0).UTC()
+}
+
+// Expired reports whether the file is past its expiry date and may be
+// missing leap seconds announced since.
+func (t *LeapTable) Expired(now time.Time) bool {
+	return t != nil && !now.Before(t.Expires)
+}
+
+// TAIOffset returns TAI-UTC in seconds at now.
+func (t *LeapTable) TAIOffset(now time.Time) int {
+	if t == nil {
+		return 0
+	}
+	offset := 0
+	for _, e := range t.Entries {
+		if now.Before(e.At) {
+			break
+		}
+		offset = e.TAIOffset
+	}
+	return offset
+}
+
+// NextLeap returns the next scheduled leap after now and whether it
+// inserts (+1) or deletes (-1) a second.
+func (t *LeapTable) NextLeap(now time.Time) (LeapEntry, int, bool) {
+	if t == nil {
+		return LeapEntry{}, 0, false
+	}
+	prev := 0
+	for i, e := range t.Entries {
+		if i > 0 {
+			prev = t.Entries[i-1].TAIOffset
+		}
+		if now.Before(e.At) && i > 0 {
+			return e, e.TAIOffset - prev, true
+		}
+	}
+	return LeapEntry{}, 0, false
+}
+
+// Indicator returns the leap indicator to serve at now: LeapAddSecond or
+// LeapDelSecond during the UTC month that ends with a scheduled leap,
+// LeapNoWarning otherwise. Entries already in the file stay valid after it
+// expires; only leaps announced since are missing, which main warns about.
+//
+// NTP timestamps, like the system clock, repeat the second 23:59:59 when a
+// leap second is inserted, so timestamps need no correction across the leap;
+// only the indicator must stay set until the repeated second is over. After
+// the kernel steps back the clock reads before the leap again, so the
+// comparison with At keeps LI set through the inserted second.
+func (t *LeapTable) Indicator(now time.Time) uint8 {
+	next, delta, ok := t.NextLeap(now)
+	if !ok {
+		return LeapNoWarning
+	}
+	last := next.At.Add(-time.Second) //闰秒所在月份的最后一秒
+	now = now.UTC()
+	if now.Year() != last.Year() || now.Month() != last.Month() {
+		return LeapNoWarning
+	}
+	if delta > 0 {
+		return LeapAddSecond
+	}
+	return LeapDelSecond
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeapIndicator(t *testing.T) {
+	table := &LeapTable{
+		Entries: []LeapEntry{
+			{At: time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC), TAIOffset: 36},
+			{At: leap2016, TAIOffset: 37},
+		},
+		Expires: time.Date(2017, 6, 28, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name string
+		now  time.Time
+		want uint8
+	}{
+		{"month before", time.Date(2016, 11, 30, 12, 0, 0, 0, time.UTC), LeapNoWarning},
+		{"leap month", time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), LeapAddSecond},
+		{"last second", leap2016.Add(-time.Second), LeapAddSecond},
+		{"after leap", leap2016.Add(time.Hour), LeapNoWarning},
+	}
+	for _, tt := range tests {
+		if got := table.Indicator(tt.now); got != tt.want {
+			t.Errorf("%s: LI %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// 文件过期后已有的闰秒照常发布
+	table.Expires = time.Date(2016, 12, 15, 0, 0, 0, 0, time.UTC)
+	if got := table.Indicator(time.Date(2016, 12, 20, 0, 0, 0, 0, time.UTC)); got != LeapAddSecond {
+		t.Errorf("after expiry: LI %d, want %d", got, LeapAddSecond)
+	}
+}
+
+// TestLeapAfterExpiry checks that NTP, PTP and the smear all keep using a
+// leap second from an expired file.
+func TestLeapAfterExpiry(t *testing.T) {
+	clock := &fakeClock{t: leap2016.Add(-time.Hour)}
+	expires := time.Date(2016, 12, 15, 0, 0, 0, 0, time.UTC)
+
+	ntp := newSmearService(clock)
+	ntp.Leap.Expires = expires
+	if !ntp.Leap.Expired(clock.Now()) {
+		t.Fatal("table not expired")
+	}
+	if offset := ntp.SmearOffset(); offset >= 0 {
+		t.Errorf("smear offset %v an hour before the leap, want negative", offset)
+	}
+
+	ntp.Smear = nil
+	if li := ntp.SystemVars(ntp.Now()).Leap; li != LeapAddSecond {
+		t.Errorf("NTP LI %d, want %d", li, LeapAddSecond)
+	}
+	_, offset, flags := (&PTPMaster{Service: ntp}).timescale()
+	if flags&ptpFlagLeap61 == 0 || offset != 36 {
+		t.Errorf("PTP flags %#04x currentUtcOffset %d, want leap61 and 36", flags, offset)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultManycastServers  = 3                //manycast客户端最多建立的关联数
+	DefaultManycastWait     = 2 * time.Second  //发出manycast请求后收集应答的时间
+	DefaultManycastInterval = 10 * time.Minute //关联不足时重新发现的间隔
+)
+
+// ManycastServer answers client requests sent to a multicast group, but
+// only while the server is synchronised, so that clients discovering
+// servers never pick one without a good time source (RFC 5905 3.1).
+type ManycastServer struct {
+	Service   *NTPService
+	Policy    *AccessPolicy
+	Group     *net.UDPAddr
+	Interface *net.Interface
+}
+
+// Run joins the group and serves requests until the socket fails. The
+// socket is bound to the group address, so unicast requests keep arriving
+// on the main socket.
+func (s *ManycastServer) Run() error {
+	conn, err := listenMulticastGroup(s.Group, s.Interface)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Println("Listening for manycast requests on", s.Group)
+	return s.Serve(conn)
+}
+
+// Serve answers manycast requests arriving on conn until reading fails.
+func (s *ManycastServer) Serve(conn *net.UDPConn) error {
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		recvTime := s.Service.Now()
+		if err != nil {
+			return err
+		}
+		if n < NtpV4PacketSize || n%4 != 0 || buf[0]&0x07 != ModeClient {
+			continue
+		}
+		if !s.Service.Sync.Synchronized(recvTime) {
+			continue //未同步时不应答，客户端会选择其他服务器
+		}
+		// 组播请求一律不回复KoD，避免一个请求引发大量KoD
+		if s.Policy.Decide(addr.IP, recvTime) != PolicyServe {
+			continue
+		}
+		s.Service.HandleStanderNTPServer(buf[:n], conn, addr, recvTime)
+	}
+}
+
+// ManycastClient discovers servers by sending a client request to a
+// multicast group and mobilizes the best responders as client associations.
+type ManycastClient struct {
+	Service   *NTPService
+	Assocs    *AssociationManager
+	Group     *net.UDPAddr
+	TTL       int
+	Interface *net.Interface
+	KeyID     uint32        //非0时请求带MAC，只接受用该密钥签名的应答
+	Servers   int           //最多建立的关联数
+	Wait      time.Duration //收集应答的时间
+	Interval  time.Duration //关联不足时重新发现的间隔
+	Poll      time.Duration //新建关联的轮询间隔
+}
+
+type manycastResponder struct {
+	addr   *net.UDPAddr
+	sample Sample
+}
+
+// Run discovers servers now and again every Interval while fewer than
+// Servers associations are reachable, until stop is closed.
+func (c *ManycastClient) Run(stop <-chan struct{}) {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultManycastInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if need := c.servers() - c.reachable(); need > 0 {
+			responders, err := c.discover()
+			if err != nil {
+				fmt.Println("Manycast discovery failed:", err)
+			}
+			for _, r := range responders {
+				if need == 0 {
+					break
+				}
+				if c.Assocs.Has(r.addr) {
+					continue
+				}
+				if _, err := c.Assocs.AddServer(r.addr, c.KeyID, c.Poll); err != nil {
+					fmt.Println("Manycast:", err)
+					continue
+				}
+				fmt.Printf("Manycast mobilized %s stratum %d delay %v\n", r.addr, r.sample.Stratum, r.sample.Delay)
+				need--
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *ManycastClient) servers() int {
+	if c.Servers <= 0 {
+		return DefaultManycastServers
+	}
+	return c.Servers
+}
+
+// reachable counts client associations that answered recently.
+func (c *ManycastClient) reachable() int {
+	count := 0
+	for _, a := range c.Assocs.Associations() {
+		if a.HostMode == ModeClient && a.Reach != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// discover sends one request to the group and returns the synchronised
+// responders, best first: lowest stratum, then lowest delay.
+func (c *ManycastClient) discover() ([]manycastResponder, error) {
+	ipv6 := c.Group.IP.To4() == nil
+	network := "udp4"
+	if ipv6 {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = DefaultMulticastTTL
+	}
+	if err := setMulticastOptions(conn, ipv6, ttl, c.Interface); err != nil {
+		fmt.Println("WARNING: cannot set multicast TTL/interface:", err)
+	}
+
+	clock := c.Service.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	req, xmt, err := newClientRequest(clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	var key *SymmetricKey
+	if c.KeyID != 0 {
+		var ok bool
+		if key, ok = c.Service.Keys.Lookup(c.KeyID); !ok {
+			return nil, fmt.Errorf("manycast: %w %d", ErrUnknownKey, c.KeyID)
+		}
+		req = key.Sign(req)
+	}
+	wait := c.Wait
+	if wait <= 0 {
+		wait = DefaultManycastWait
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	t1 := clock.Now()
+	if _, err := conn.WriteToUDP(req, c.Group); err != nil {
+		return nil, err
+	}
+
+	var responders []manycastResponder
+	seen := make(map[string]bool)
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		t4 := clock.Now()
+		if err != nil {
+			break //收集时间结束
+		}
+		var resp NTPv4Packet
+		if err := resp.UnmarshalBinary(buf[:n]); err != nil || resp.Mode != ModeServer || resp.OrigTimestamp != xmt {
+			continue
+		}
+		if key != nil {
+			if resp.Auth == nil || resp.Auth.KeyID != key.ID {
+				continue
+			}
+			if _, err := c.Service.Keys.Verify(buf[:n], resp.Auth); err != nil {
+				continue
+			}
+		}
+		sample, err := newSample(&resp, t1, t4)
+		if err != nil || seen[addr.String()] {
+			continue
+		}
+		seen[addr.String()] = true
+		responders = append(responders, manycastResponder{addr: addr, sample: sample})
+	}
+	sort.Slice(responders, func(i, j int) bool {
+		a, b := responders[i].sample, responders[j].sample
+		if a.Stratum != b.Stratum {
+			return a.Stratum < b.Stratum
+		}
+		return a.Delay < b.Delay
+	})
+	return responders, nil
+}
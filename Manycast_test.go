@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestManycastLoopback serves manycast requests on 127.0.0.1 and lets a
+// manycast client discover the server through the same unicast address.
+func TestManycastLoopback(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ntp := &NTPService{Sync: &SyncState{}}
+	server := &ManycastServer{Service: ntp}
+	go server.Serve(conn)
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	req, _, err := newClientRequest(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exchange(t, addr, req, 200*time.Millisecond) != nil {
+		t.Fatal("unsynchronised manycast server replied")
+	}
+
+	ntp.Sync.Set(SyncUpdate{Source: net.IPv4(192, 0, 2, 1), Stratum: 1}, time.Now())
+	buf := exchange(t, addr, req, time.Second)
+	var resp NTPv4Packet
+	if buf == nil || resp.UnmarshalBinary(buf) != nil {
+		t.Fatal("no reply from synchronised manycast server")
+	}
+	if resp.Mode != ModeServer || resp.Stratum != 2 {
+		t.Errorf("mode %d stratum %d, want 4 2", resp.Mode, resp.Stratum)
+	}
+
+	assocs := NewAssociationManager(&NTPService{Sync: &SyncState{}}, nil)
+	client := &ManycastClient{Service: &NTPService{}, Assocs: assocs, Group: addr, Servers: 1, Wait: 200 * time.Millisecond}
+	stop := make(chan struct{})
+	close(stop)
+	client.Run(stop) //只做一次发现
+	if !assocs.Has(addr) || len(assocs.Associations()) != 1 {
+		t.Fatalf("associations %+v, want one for %v", assocs.Associations(), addr)
+	}
+	if a := assocs.Associations()[0]; a.HostMode != ModeClient {
+		t.Errorf("mobilized mode %d, want client", a.HostMode)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MS-SNTP authenticator layouts ([MS-SNTP] 2.2)
+const (
+	MsSntpPacketSize         = NtpV3PacketSize //48 + Key Identifier 4 + Crypto-Checksum 16
+	MsSntpExtendedPacketSize = 120             //48 + Key Identifier 4 + Reserved/Flags/Hints/HashID 4 + Crypto-Checksum 64
+	msSntpKeySelectorBit     = 0x80000000      //Key Identifier最高位：1表示使用上一个机器密码
+	msSntpHintSHA512         = 0x01            //ClientHashIDHints：客户端支持SHA512
+	msSntpSignatureSHA512    = 0x01            //SignatureHashID
+	ntHashLength             = 16
+)
+
+// ErrMsSntpNoKey is returned when no machine key is known for a RID.
+var ErrMsSntpNoKey = errors.New("ms-sntp: no machine key for RID")
+
+// MsSntpKeyProvider looks up the secret of a domain machine account. The
+// key is the NT hash (MD4 of the UTF-16LE password) of the account's
+// current or previous password, as held by the domain controller.
+type MsSntpKeyProvider interface {
+	MachineKey(rid uint32, previous bool) ([]byte, error)
+}
+
+// FileMsSntpKeyProvider is a MsSntpKeyProvider backed by a local file, for
+// testing without a domain controller. Each non-comment line is
+//
+//	rid current-nt-hash-hex [previous-nt-hash-hex]
+type FileMsSntpKeyProvider struct {
+	mu   sync.RWMutex
+	keys map[uint32][2][]byte
+}
+
+// LoadMsSntpKeyFile reads a machine key file.
+func LoadMsSntpKeyFile(path string) (*FileMsSntpKeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &FileMsSntpKeyProvider{keys: make(map[uint32][2][]byte)}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"rid current [previous]\"", path, lineNo)
+		}
+		rid, err := strconv.ParseUint(fields[0], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid RID %q", path, lineNo, fields[0])
+		}
+		var pair [2][]byte
+		for i, h := range fields[1:] {
+			key, err := hex.DecodeString(h)
+			if err != nil || len(key) != ntHashLength {
+				return nil, fmt.Errorf("%s:%d: NT hash must be 32 hex digits", path, lineNo)
+			}
+			pair[i] = key
+		}
+		p.keys[uint32(rid)] = pair
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// MachineKey implements MsSntpKeyProvider.
+func (p *FileMsSntpKeyProvider) MachineKey(rid uint32, previous bool) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pair, ok := p.keys[rid]
+	idx := 0
+	if previous {
+		idx = 1
+	}
+	if !ok || pair[idx] == nil {
+		return nil, ErrMsSntpNoKey
+	}
+	return pair[idx], nil
+}
+
+// IsMicrosoftNtpRequest reports whether pkt has an MS-SNTP authenticator:
+// a 68-byte request whose checksum is all zero, or a 120-byte NTPv3 request
+// with the extended authenticator. A real symmetric-key MD5 MAC is also 68
+// bytes but never all zero. An NTPv4 request with extension fields and a
+// MAC can also add up to 120 bytes, so the extended form is only taken for
+// NTPv3, which has no extension fields and no 72-byte MAC.
+func IsMicrosoftNtpRequest(pkt []byte) bool {
+	switch len(pkt) {
+	case MsSntpPacketSize:
+		for _, b := range pkt[NtpV4PacketSize+4:] {
+			if b != 0 {
+				return false
+			}
+		}
+		return true
+	case MsSntpExtendedPacketSize:
+		// Key Identifier之后依次为Reserved(必须为0)、Flags、ClientHashIDHints、SignatureHashID
+		version := (pkt[0] >> 3) & 0x07
+		return version == 3 && pkt[0]&0x07 == ModeClient && pkt[NtpV4PacketSize+4] == 0
+	}
+	return false
+}
+
+// HandleMicrosoftNTPServer answers an MS-SNTP authenticated request from a
+// Windows domain member with a response signed by its machine account key.
+func (ntp *NTPService) HandleMicrosoftNTPServer(buf []byte, conn *net.UDPConn, tarAddr *net.UDPAddr, recvTime time.Time) {
+	pkt, err := ParseNTPPacket(buf[:NtpV4PacketSize])
+	if err != nil {
+		ntp.debugln("Error parsing MS-SNTP packet from", tarAddr, err)
+		return
+	}
+	ntp.Stats.countRequest(pkt.Version)
+	keyID := binary.BigEndian.Uint32(buf[NtpV4PacketSize : NtpV4PacketSize+4])
+	rid := keyID &^ msSntpKeySelectorBit
+	key, err := ntp.MsSntp.MachineKey(rid, keyID&msSntpKeySelectorBit != 0)
+	if err != nil {
+		// 找不到机器密钥时不应答，Windows客户端会把未签名的响应当作攻击
+		ntp.debugln("MS-SNTP request from", tarAddr, "RID", rid, err)
+		return
+	}
+
+	resp, err := CreateNTPResponse(pkt, tarAddr.Port, recvTime, ntp.SystemVars(recvTime))
+	if err != nil {
+		fmt.Println("Error creating MS-SNTP response:", err)
+		return
+	}
+	StampTransmitTimestamp(resp, ntp.Now())
+	resp = signMsSntpResponse(resp, buf, key)
+	if _, err = conn.WriteToUDP(resp, tarAddr); err != nil {
+		fmt.Println("Error sending MS-SNTP response:", err)
+	}
+}
+
+// signMsSntpResponse appends the authenticator matching the request's
+// layout. The 68-byte form carries MD5(key || header); the 120-byte
+// extended form carries SHA512(key || header) when the client hints that
+// it supports SHA512, and otherwise falls back to the 68-byte form.
+func signMsSntpResponse(resp, req, key []byte) []byte {
+	header := resp[:NtpV4PacketSize]
+	keyID := req[NtpV4PacketSize : NtpV4PacketSize+4]
+	if len(req) == MsSntpExtendedPacketSize && req[NtpV4PacketSize+6]&msSntpHintSHA512 != 0 {
+		h := sha512.New()
+		h.Write(key)
+		h.Write(header)
+		resp = append(resp, keyID...)
+		resp = append(resp, 0, req[NtpV4PacketSize+5], req[NtpV4PacketSize+6], msSntpSignatureSHA512)
+		return append(resp, h.Sum(nil)...)
+	}
+	h := md5.New()
+	h.Write(key)
+	h.Write(header)
+	resp = append(resp, keyID...)
+	return append(resp, h.Sum(nil)...)
+}
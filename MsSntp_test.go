@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRID = 1105
+
+var testNTHash = bytes.Repeat([]byte{0x42}, ntHashLength)
+
+// msSntpRequest builds a client request of the given version followed by
+// an MS-SNTP authenticator for testRID. extended selects the 120-byte form
+// with SHA512 hinted.
+func msSntpRequest(t *testing.T, version uint8, extended bool) []byte {
+	t.Helper()
+	req, err := NewPacketBuilder().Version(version).Mode(ModeClient).Transmit(NewNtpTimestamp(time.Now())).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyID [4]byte
+	binary.BigEndian.PutUint32(keyID[:], testRID)
+	req = append(req, keyID[:]...)
+	if !extended {
+		return append(req, make([]byte, 16)...)
+	}
+	req = append(req, 0, 0, msSntpHintSHA512, 0)
+	return append(req, make([]byte, 64)...)
+}
+
+// efMACRequest is an NTPv4 request with one extension field and a SHA1 MAC
+// that happens to be exactly 120 bytes long.
+func efMACRequest(t *testing.T, key *SymmetricKey) []byte {
+	t.Helper()
+	req, err := NewPacketBuilder().Mode(ModeClient).Transmit(NewNtpTimestamp(time.Now())).
+		AddExtension(0x0900, make([]byte, 44)).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.Sign(req)
+}
+
+func TestIsMicrosoftNtpRequest(t *testing.T) {
+	sha1Key := &SymmetricKey{ID: 7, Type: KeyTypeSHA1, Secret: []byte("secret")}
+	md5Key := &SymmetricKey{ID: 1, Type: KeyTypeMD5, Secret: []byte("secret")}
+	plain, _ := NewPacketBuilder().Version(3).Mode(ModeClient).Bytes()
+	ext := msSntpRequest(t, 3, true)
+	ext[NtpV4PacketSize+4] = 1 //Reserved不为0
+	tests := []struct {
+		name string
+		req  []byte
+		want bool
+	}{
+		{"68-byte MS-SNTP", msSntpRequest(t, 3, false), true},
+		{"120-byte MS-SNTP", msSntpRequest(t, 3, true), true},
+		{"plain v3", plain, false},
+		{"v3 MD5 MAC", md5Key.Sign(plain), false},
+		{"v4 EF+MAC of 120 bytes", efMACRequest(t, sha1Key), false},
+		{"120-byte extended as v4", msSntpRequest(t, 4, true), false},
+		{"120-byte with reserved set", ext, false},
+	}
+	for _, tt := range tests {
+		if got := IsMicrosoftNtpRequest(tt.req); got != tt.want {
+			t.Errorf("%s (%d bytes): got %v, want %v", tt.name, len(tt.req), got, tt.want)
+		}
+	}
+}
+
+func TestMsSntpLoopback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mssntp.keys")
+	if err := os.WriteFile(path, []byte("# rid current\n1105 "+hex.EncodeToString(testNTHash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := LoadMsSntpKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha1Key := &SymmetricKey{ID: 7, Type: KeyTypeSHA1, Secret: []byte("secret")}
+	keys := NewKeyStore()
+	keys.Add(sha1Key)
+	server := serveNTP(t, &NTPService{MsSntp: provider, Keys: keys})
+
+	// 68字节请求：MD5(机器密钥 || 应答头部)
+	resp := exchange(t, server, msSntpRequest(t, 3, false), time.Second)
+	if len(resp) != MsSntpPacketSize {
+		t.Fatalf("68-byte request: reply of %d bytes", len(resp))
+	}
+	sum := md5.Sum(append(append([]byte(nil), testNTHash...), resp[:NtpV4PacketSize]...))
+	if !bytes.Equal(resp[NtpV4PacketSize+4:], sum[:]) {
+		t.Error("68-byte reply: bad MD5 checksum")
+	}
+
+	// 120字节请求且提示SHA512：SHA512(机器密钥 || 应答头部)
+	resp = exchange(t, server, msSntpRequest(t, 3, true), time.Second)
+	if len(resp) != MsSntpExtendedPacketSize {
+		t.Fatalf("120-byte request: reply of %d bytes", len(resp))
+	}
+	sum512 := sha512.Sum512(append(append([]byte(nil), testNTHash...), resp[:NtpV4PacketSize]...))
+	if resp[NtpV4PacketSize+7] != msSntpSignatureSHA512 || !bytes.Equal(resp[NtpV4PacketSize+8:], sum512[:]) {
+		t.Error("120-byte reply: bad SHA512 signature")
+	}
+
+	// 同样是120字节的NTPv4 扩展字段+MAC 请求按标准认证处理
+	req := efMACRequest(t, sha1Key)
+	resp = exchange(t, server, req, time.Second)
+	var pkt NTPv4Packet
+	if resp == nil || pkt.UnmarshalBinary(resp) != nil {
+		t.Fatal("no standard reply to a 120-byte NTPv4 EF+MAC request")
+	}
+	if pkt.Version != 4 || pkt.Auth == nil || pkt.Auth.KeyID != sha1Key.ID {
+		t.Fatalf("reply version %d auth %+v, want v4 signed with key %d", pkt.Version, pkt.Auth, sha1Key.ID)
+	}
+	if _, err := keys.Verify(resp, pkt.Auth); err != nil {
+		t.Error("reply MAC:", err)
+	}
+}
@@ -8,27 +8,246 @@ import (
 )
 
 type NTPService struct {
+	Keys        *KeyStore         //对称密钥 ntp.keys，nil表示未配置
+	RequireAuth bool              //为true时丢弃不带MAC的请求
+	NTS         *NtsCookieJar     //NTS cookie主密钥，nil表示未启用NTS
+	MsSntp      MsSntpKeyProvider //Windows域成员机器密钥，nil表示不处理MS-SNTP
+	Leap        *LeapTable        //leap-seconds.list，nil表示不发布闰秒
+	Smear       *LeapSmear        //闰秒平滑，非nil时不设置LI而是在窗口内线性调整服务时间
+	Clock       Clock             //时间源，nil表示系统时钟
+	Sync        *SyncState        //外部时间源的同步结果，nil表示直接使用本地时钟
+	Interleaved *InterleavedTable //交错模式时间戳表，nil表示只支持基本模式
+	Stats       *ServerStats      //按版本统计的请求数，nil表示不统计
+	Verbose     bool              //记录每个被丢弃的请求和每个时间样本
 }
 
-func (ntp *NTPService) HandleStanderNTPServer(buf []byte, conn *net.UDPConn, tarAddr *net.UDPAddr) {
+// debugln logs a per-packet or per-sample message when Verbose is set. How
+// often these happen is up to whoever sends us packets, so they are off by
+// default.
+func (ntp *NTPService) debugln(a ...interface{}) {
+	if ntp.Verbose {
+		fmt.Println(a...)
+	}
+}
+
+// debugf is debugln with a format.
+func (ntp *NTPService) debugf(format string, a ...interface{}) {
+	if ntp.Verbose {
+		fmt.Printf(format, a...)
+	}
+}
+
+// Now returns the time the server serves: the clock reading corrected by
+// the synchronisation offset, plus the current leap smear offset.
+func (ntp *NTPService) Now() time.Time {
+	now := ntp.localNow()
+	if ntp.Smear != nil {
+		now = now.Add(ntp.Smear.Offset(now))
+	}
+	return now
+}
+
+// localNow is the synchronised time before leap smearing.
+func (ntp *NTPService) localNow() time.Time {
+	clock := ntp.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return clock.Now().Add(ntp.Sync.Offset())
+}
+
+// SmearOffset returns the current leap smear offset, for monitoring.
+func (ntp *NTPService) SmearOffset() time.Duration {
+	if ntp.Smear == nil {
+		return 0
+	}
+	return ntp.Smear.Offset(ntp.localNow())
+}
+
+// ClockOffset returns how far the served time is ahead of the Clock. Time
+// sources subtract it from a served receive time to measure against the
+// bare clock.
+func (ntp *NTPService) ClockOffset() time.Duration {
+	return ntp.Sync.Offset() + ntp.SmearOffset()
+}
+
+// clockPrecision is the assumed error of the local clock when nothing better
+// is known.
+const clockPrecision = time.Millisecond
+
+// ErrorEstimate bounds how far the served time may be from the time source
+// at now: the clock precision plus the drift accumulated at MaxClockDrift
+// since the last synchronisation.
+func (ntp *NTPService) ErrorEstimate(now time.Time) time.Duration {
+	return clockPrecision + time.Duration(float64(ntp.Sync.Age(now))*MaxClockDrift)
+}
+
+const (
+	localStratum  = 3      //直接使用本地时钟时发布的stratum
+	maxStratum    = 16     //RFC 5905 未同步
+	unsyncRefCode = "INIT" //尚未同步时的Reference ID
+)
+
+// localRefIP is the Reference ID of the local clock. ASCII codes are only
+// allowed at stratum 0 and 1 (RFC 5905 7.3), so at localStratum it is
+// ntpd's LOCAL clock driver address, which no client mistakes for a server.
+var localRefIP = net.IPv4(127, 127, 1, 0)
+
+// SystemVars are the RFC 5905 system variables copied into every response.
+type SystemVars struct {
+	Leap      uint8         //闰秒指示 LI
+	Stratum   uint8         //时间源stratum+1，本地时钟为localStratum
+	RefID     uint32        //时间源地址或参考代码
+	RefTime   NtpTimestamp  //最近一次同步的时间
+	RootDelay time.Duration //到主参考源的总往返延迟
+	RootDisp  time.Duration //到主参考源的总离散度，含同步后累积的漂移
+}
+
+// RootDistance is the maximum error of the served time relative to the
+// primary reference (RFC 5905 11.2).
+func (sys SystemVars) RootDistance() time.Duration {
+	return sys.RootDelay/2 + sys.RootDisp
+}
+
+// SystemVars returns the system variables to serve at now. Synchronised to
+// a time source the server is one stratum below it and names it in the
+// Reference ID; with a nil Sync it serves its local clock.
+func (ntp *NTPService) SystemVars(now time.Time) SystemVars {
+	sys := SystemVars{
+		Stratum:  localStratum,
+		RefID:    refIDFromIP(localRefIP),
+		RefTime:  NewNtpTimestamp(now),
+		RootDisp: ntp.ErrorEstimate(now),
+	}
+	if ntp.Sync != nil {
+		if !ntp.Sync.Synchronized(now) {
+			//尚未从外部时间源同步
+			return SystemVars{Leap: LeapNotInSync, Stratum: maxStratum, RefID: refIDFromCode(unsyncRefCode)}
+		}
+		last, updated := ntp.Sync.Last()
+		sys.Stratum = last.Stratum + 1
+		if sys.Stratum >= maxStratum {
+			sys.Stratum = maxStratum - 1
+		}
+		sys.RefID = refIDFromIP(last.Source)
+		sys.RefTime = NewNtpTimestamp(updated)
+		sys.RootDelay = last.RootDelay
+		sys.RootDisp += last.RootDisp
+	}
+	sys.Leap = ntp.Leap.Indicator(now)
+	if ntp.Smear != nil {
+		sys.Leap = LeapNoWarning //平滑模式下闰秒对客户端不可见
+	}
+	return sys
+}
+
+// HandleStanderNTPServer answers a client request. recvTime is the moment the
+// request was read from the socket and becomes the Receive Timestamp.
+func (ntp *NTPService) HandleStanderNTPServer(buf []byte, conn *net.UDPConn, tarAddr *net.UDPAddr, recvTime time.Time) {
 	pkt, err := ParseNTPPacket(buf)
 	if err != nil {
-		fmt.Println("Error parsing packet:", err)
+		ntp.debugln("Error parsing packet from", tarAddr, err)
+		return
+	}
+	ntp.Stats.countRequest(pkt.Version)
+
+	// NTS RFC 8915：带cookie的请求走NTS认证
+	var nts *ntsRequest
+	if ntp.NTS != nil && IsNtsRequest(&pkt) {
+		nts, err = ntp.NTS.OpenRequest(buf, &pkt)
+		if err == ErrNtsCookie && nts != nil {
+			ntp.sendNtsNak(pkt, nts, conn, tarAddr, recvTime)
+			return
+		}
+		if err != nil {
+			ntp.debugln("NTS request rejected:", tarAddr, err)
+			return
+		}
+	}
+
+	// 对称密钥认证 RFC 5905 / RFC 8573
+	var key *SymmetricKey
+	nak := false
+	if nts != nil {
+		// NTS请求由Authenticator认证，不再检查MAC
+	} else if pkt.Auth != nil && !pkt.Auth.IsCryptoNAK() {
+		key, err = ntp.Keys.Verify(buf, pkt.Auth)
+		if err != nil {
+			ntp.debugln("Authentication failed:", tarAddr, "key", pkt.Auth.KeyID, err)
+			nak = true
+		}
+	} else if ntp.RequireAuth {
+		ntp.debugln("Dropping unauthenticated request from", tarAddr)
 		return
 	}
 
 	// Create response packet
-	resp, err := CreateNTPResponse(pkt)
+	resp, err := CreateNTPResponse(pkt, tarAddr.Port, recvTime, ntp.SystemVars(recvTime))
 	if err != nil {
 		fmt.Println("Error creating response packet:", err)
 		return
 	}
-	// Send response
+	// Send response 发送前最后一刻填入发送时间戳，MAC要覆盖发送时间戳所以在其后签名
+	if prevTx, ok := ntp.Interleaved.Match(tarAddr.IP, &pkt); ok {
+		// 交错模式：Origin填请求中的Receive，Transmit填上一个应答的实际发送时间
+		binary.BigEndian.PutUint64(resp[24:32], uint64(pkt.RecvTimestamp))
+		binary.BigEndian.PutUint64(resp[40:48], uint64(prevTx))
+	} else {
+		StampTransmitTimestamp(resp, ntp.Now())
+	}
+	if nak {
+		resp = appendCryptoNAK(resp)
+	} else if key != nil {
+		resp = key.Sign(resp)
+	} else if nts != nil {
+		if resp, err = ntp.NTS.Seal(resp, nts); err != nil {
+			fmt.Println("Error sealing NTS response:", err)
+			return
+		}
+	}
 	_, err = conn.WriteToUDP(resp, tarAddr)
 	if err != nil {
 		fmt.Println("Error sending response:", err)
 		return
 	}
+	// WriteToUDP返回后的时间比填入的发送时间戳更接近报文实际发出的时刻
+	ntp.Interleaved.Save(tarAddr.IP, NewNtpTimestamp(recvTime), NewNtpTimestamp(ntp.Now()))
+}
+
+// sendNtsNak answers a request whose cookie cannot be opened with an NTS
+// NAK: a kiss-o'-death packet with code NTSN echoing the Unique Identifier.
+func (ntp *NTPService) sendNtsNak(pkt NTPv4Packet, nts *ntsRequest, conn *net.UDPConn, tarAddr *net.UDPAddr, recvTime time.Time) {
+	resp, err := CreateKoDResponse(pkt, tarAddr.Port, KissNtsNak, recvTime)
+	if err != nil {
+		fmt.Println("Error creating NTS NAK:", err)
+		return
+	}
+	StampTransmitTimestamp(resp, ntp.Now())
+	if _, err = conn.WriteToUDP(AppendNtsNak(resp, nts), tarAddr); err != nil {
+		fmt.Println("Error sending NTS NAK:", err)
+	}
+}
+
+// SendKissOfDeath answers the request in buf with a kiss-o'-death packet
+// carrying code instead of the time.
+func (ntp *NTPService) SendKissOfDeath(buf []byte, conn *net.UDPConn, tarAddr *net.UDPAddr, recvTime time.Time, code string) {
+	pkt, err := ParseNTPPacket(buf[:NtpV4PacketSize])
+	if err != nil {
+		ntp.debugln("Error parsing packet from", tarAddr, err)
+		return
+	}
+	if pkt.Mode != ModeClient && pkt.Mode != ModeSymmetricActive && pkt.Mode != ModeReserved {
+		return //只对客户端、主动对等体和NTPv1的请求发送KoD
+	}
+	resp, err := CreateKoDResponse(pkt, tarAddr.Port, code, recvTime)
+	if err != nil {
+		fmt.Println("Error creating KoD packet:", err)
+		return
+	}
+	StampTransmitTimestamp(resp, ntp.Now())
+	if _, err = conn.WriteToUDP(resp, tarAddr); err != nil {
+		fmt.Println("Error sending KoD packet:", err)
+	}
 }
 
 // ParseNTPPacket parses an NTP packet
@@ -50,39 +269,18 @@ func ParseNTPPacket(buf []byte) (NTPv4Packet, error) {
 		Auth              [8]uint8 //Authentication字段：64bit，用来验证报文的可靠性
 	*/
 	var pkt NTPv4Packet
-	// Parse packet
-	//假设初始值位0x23 二进制位（0b 00100011） wireshark抓包后识别 0-1 LI 位00 2-4位LN 100 5-7位Mode 11
-	//LeapIndicator 跳跃指示器（LeapIndicator）：2bit，指示NTP协议运行的状态，分为正常、提前、延后和未知状态。
-	pkt.LeapIndicator = (buf[0] >> 6) //向右移动6位左侧剩余2位 就是头2位  |00000011=3
-	//VersionNumber NTP版本号：3bit，用来指示使用的NTP版本号
-	var temp = (buf[0] >> 4) //0b1101
-	pkt.Version = (temp & (0b111)) >> 1
-	pkt.Mode = buf[0] & (0b111)
-	pkt.Stratum = buf[1]                                  //NTP服务器的级别：8bit，用来指示NTP服务器的级别
-	pkt.PollInterval = buf[2]                             //客户端向服务器查询时间的间隔：8bit，用来指示客户端向服务器发送请求的间隔
-	pkt.Precision = buf[3]                                ////NTP服务器时间的精度：8bit，用来指示NTP服务器时间的精度 1.0seconed=0b000000
-	pkt.RootDelay = binary.BigEndian.Uint32(buf[4:8])     //根延迟：4byte=32bit，用来指示NTP客户端和服务器之间的延迟
-	pkt.RootDisp = binary.BigEndian.Uint32(buf[8:12])     //根分散：32bit，用来指示NTP客户端和服务器之间的时间分散
-	pkt.ReferenceID = binary.BigEndian.Uint32(buf[12:16]) //参考标识符：32bit，用来指示参考时钟的标识符https://www.rfc-editor.org/rfc/rfc5905 搜索关键字"Reference ID" 3/17
-	//pkt.RefTimestamp = time.Unix(int64(binary.BigEndian.Uint32(buf[16:24])-2208988800), 0).Unix()      //参考时间戳：64bit，用来指示服务器的参考时间
-	clentReftime := binary.BigEndian.Uint64(buf[16:24]) //客户端的unix时间戳 utc,
-	fmt.Println(clentReftime)
-	fmt.Println("client UnixTime=", time.Unix(int64(clentReftime), 0).UTC(), "TimeUnixMicro=", time.UnixMicro(int64(clentReftime)).UTC())
-	//从buf中解析出RefTimeStamp
-	refTimeStamp := binary.BigEndian.Uint32(buf[40:44])
-	//将RefTimeStamp转换成时间格式
-	fmt.Println("RefTimeStamp：", refTimeStamp)
-	fmt.Println("RefTimeStamp标准时间格式：", time.Unix(int64(refTimeStamp-2208988800), 0)) //----这里时间就对了是客户端现在的时间----
-	pkt.RefTimestamp = time.Unix(int64(binary.BigEndian.Uint32(buf[16:24])), 0).Unix()
-	pkt.OrigTimestamp = time.Unix(int64(binary.BigEndian.Uint32(buf[24:32])-2208988800), 0).Unix()     //发出时间戳：64bit，用来指示客户端发出请求的时间
-	pkt.RecvTimestamp = time.Unix(int64(binary.BigEndian.Uint32(buf[32:40])-2208988800), 0).Unix()     //接收时间戳：64bit，用来指示服务器接收请求的时间
-	pkt.TransmitTimestamp = time.Unix(int64(binary.BigEndian.Uint32(buf[40:48])-2208988800), 0).Unix() //发送时间戳：64bit，用来指示服务器发送响应的时间
+	// Parse packet 长度、版本、模式校验在UnmarshalBinary中完成
+	if err := pkt.UnmarshalBinary(buf); err != nil {
+		return pkt, err
+	}
 	return pkt, nil
 }
 
-func CreateNTPResponse(pkt NTPv4Packet) ([]byte, error) {
+// CreateNTPResponse builds the reply to pkt, which arrived from srcPort. The
+// Transmit Timestamp is left zero; callers fill it with
+// StampTransmitTimestamp right before sending.
+func CreateNTPResponse(pkt NTPv4Packet, srcPort int, recvTime time.Time, sys SystemVars) ([]byte, error) {
 	// Create response packet
-	var buf [NtpV4PacketSize]byte
 	/*
 			LeapIndicator     byte     //跳跃指示器（LeapIndicator）：2bit，指示NTP协议运行的状态，分为正常、提前、延后和未知状态。	[0]aabbbccc中的aa
 			Version           uint8    //NTP版本号：3bit，用来指示使用的NTP版本号				[0]aabbbccc中的bbb
@@ -113,55 +311,82 @@ func CreateNTPResponse(pkt NTPv4Packet) ([]byte, error) {
 		是的，您的理解是正确的。Mode替换为4，Stature替换为0，Root Delay替换为0，Root Dispersion替换为0，Reference Identifier替换为服务端的IP地址，Reference Timestamp替换为服务端当前的UTC时间戳，Originate Timestamp替换为客户端发送的Transmit Timestamp，Receive Timestamp替换为服务端当前的UTC时间戳，Transmit Timestamp替换为服务端当前的UTC时间戳。
 	*/
 	//buf[0]最后3位 客户端3 服务端4  client 00 100 011 server 00 100
-	var ln uint8 = 0b00000000 //pkt.LeapIndicator 服务端要给客户端00 表示时间是准确的除非服务端有其他服务器可以同步
-	ver := uint8(4)           //pkt.Version
-	mode := pkt.Mode + 0b00000001
-	result := (ln << 6) | (ver << 3) | mode
-	buf[0] = result
-	buf[0] = buf[0] & 0b11111100
-	//var test byte = 0b11111100
-	fmt.Println("buf[0]:%v", buf[0])
-	//buf[0] = (pkt.LeapIndicator << 6) | (pkt.Version << 3) | pkt.Mode
-	buf[1] = 0b00000011                //pkt.Stratum //服务器时间级别自定义为3 0b00000011=3  来时其他 2 1 级同步结果
-	buf[2] = 0b00000000                //pkt.PollInterval 可以设置为0对服务端而言 该值无意义
-	buf[3] = 0b00000000                //pkt.Precision NTP服务器时间的精度：8bit，用来指示NTP服务器时间的精度
-	copy(buf[4:8], []byte{0, 0, 0, 0}) //[4-8]	服务端自定义为0 RootDelay-int32	根延迟：32bit，用来指示NTP客户端和服务器之间的延迟
-	//binary.BigEndian.PutUint32(buf[4:8], uint32(pkt.RootDelay)) //根延迟：32bit，用来指示NTP客户端和服务器之间的延迟 RootDelay值 不包含网络传输所需时间，而是由NTP服务器从四个精确的NTP服务器获取标准时间，并计算出与服务器的延迟，然后根据计算出的延迟值计算出RootDelay的值。---RootDelay值取决于NTP服务器之间的网络延迟，如果没有其他NTP服务器可参考，可以将RootDelay值设置为0或较小的值。
-
-	copy(buf[8:12], []byte{0, 0, 0, 0}) //[8-12]	服务端自定义为0RootDisp-int32根分散：32bit，用来指示NTP客户端和服务器之间的时间分散
-	//binary.BigEndian.PutUint32(buf[8:12], uint32(pkt.RootDisp)) //RootDisp值是根据RootDelay值计算出来的，如果RootDelay值设置为0或较小的值，那么RootDisp值也会很小。
-
-	copy(buf[12:16], net.IPv4(192, 168, 16, 120)) //[12-16]	服务端自定义为服务端ip ReferenceID-uint32	参考标识符：32bit，用来指示参考时钟的标识符
-	//binary.BigEndian.PutUint32(buf[12:16], pkt.ReferenceID)//一般为服务器ipv4
-	servertime := uint64(time.Now().Unix() - 2208988800)
-	//copy(buf[16:24], string(time.Now().UTC().Unix())) //[16-24]	服务端时间time.Now().UTC().Unix() RefTimestamp-uint64	参考时间戳：64bit，用来指示服务器的参考时间
-
-	binary.BigEndian.PutUint64(buf[16:24], servertime)               //[16-24]	服务端时间time.Now().UTC().Unix() RefTimestamp-uint64	参考时间戳：64bit，用来指示服务器的参考时间
-	binary.BigEndian.PutUint64(buf[24:32], uint64(pkt.RefTimestamp)) //[24-32] 客户端时间client_pkt.Transmit	OrigTimestamp-uint64	发出时间戳：64bit，用来指示客户端发出请求的时间
-	binary.BigEndian.PutUint64(buf[32:40], servertime)               //[32-40]	服务端时间time.Now().UTC().Unix()	RecvTimestamp-uint64	接收时间戳：64bit，用来指示服务器接收请求的时间
-
-	//binary.BigEndian.PutUint32(buf[40:48], uint32(transmitTime))
-	binary.BigEndian.PutUint64(buf[40:48], servertime) //[40-48]	服务端时间time.Now().UTC().Unix()	TransmitTimestamp-uint64	发送时间戳：64bit，用来指示服务器发送响应的时间
-	return buf[:], nil
+	servertime := NewNtpTimestamp(recvTime) //服务端收到请求的时间 NTP格式 含32位小数部分
+	return newServerPacket(sys).
+		Version(pkt.Version).          //按请求的版本应答 老设备会丢弃版本不一致的应答
+		Mode(replyMode(pkt, srcPort)). //客户端3 -> 服务端4 NTPv1的0按源端口 -> 2或4
+		Origin(pkt.TransmitTimestamp). //[24-32] 客户端时间client_pkt.Transmit 原样拷贝
+		Receive(servertime).           //[32-40] 服务端ReadFromUDP返回的时间
+		Bytes()                        //[40-48] TransmitTimestamp 由StampTransmitTimestamp在WriteToUDP前填入
+}
+
+// newServerPacket fills the header fields that describe this server rather
+// than one exchange; callers add the mode and timestamps.
+func newServerPacket(sys SystemVars) *PacketBuilder {
+	return NewPacketBuilder().
+		Leap(sys.Leap).               //00 表示时间准确 01/10 表示本月末将插入/删除闰秒
+		Version(4).                   //对等体/广播报文使用v4 应答由调用方改为请求的版本
+		Stratum(sys.Stratum).         //上游stratum+1，本地时钟为3
+		Poll(0).                      //pkt.PollInterval 可以设置为0对服务端而言 该值无意义
+		Precision(0).                 //pkt.Precision NTP服务器时间的精度
+		RootDelay(sys.RootDelay).     //[4-8] 到主参考源的往返延迟
+		RootDispersion(sys.RootDisp). //[8-12] 到主参考源的离散度
+		ReferenceID(sys.RefID).       //[12-16] 上游服务器地址，本地时钟为127.127.1.0
+		Reference(sys.RefTime)        //[16-24] 最近一次同步的时间 参考时间戳
+}
+
+// CreateKoDResponse builds a kiss-o'-death reply to pkt (RFC 5905 7.4):
+// LI=3, stratum 0 and the ASCII kiss code in the Reference ID. Like
+// CreateNTPResponse it leaves the Transmit Timestamp for the caller.
+func CreateKoDResponse(pkt NTPv4Packet, srcPort int, code string, recvTime time.Time) ([]byte, error) {
+	return NewPacketBuilder().
+		Leap(LeapNotInSync).           //LI=3 告警
+		Version(pkt.Version).          //与请求版本一致
+		Mode(replyMode(pkt, srcPort)). //回复客户端用4 回复主动对等体用2
+		Stratum(0).                    //stratum 0 表示Kiss-o'-Death
+		ReferenceCode(code).           //RATE / DENY / RSTR / NTSN
+		Origin(pkt.TransmitTimestamp). //客户端据此匹配请求
+		Receive(NewNtpTimestamp(recvTime)).
+		Bytes()
+}
+
+// replyMode returns the mode of a reply to pkt from srcPort: server for
+// client requests and symmetric passive for symmetric active peers. NTPv1
+// requests carry no mode (RFC 1059); following RFC 1305 appendix B they
+// come from a peer when sent from port 123 and from a client otherwise.
+func replyMode(pkt NTPv4Packet, srcPort int) uint8 {
+	switch {
+	case pkt.Mode == ModeSymmetricActive:
+		return ModeSymmetricPassive
+	case pkt.Mode == ModeReserved && srcPort == 123:
+		return ModeSymmetricPassive
+	}
+	return ModeServer
+}
 
+// StampTransmitTimestamp writes t into the Transmit Timestamp of an encoded
+// response. Call it as late as possible before the packet is written.
+func StampTransmitTimestamp(resp []byte, t time.Time) {
+	binary.BigEndian.PutUint64(resp[40:48], uint64(NewNtpTimestamp(t)))
 }
 
 // NTPv4 structure
 type NTPv4Packet struct {
-	LeapIndicator     byte     //跳跃指示器（LeapIndicator）：2bit，指示NTP协议运行的状态，分为正常、提前、延后和未知状态。
-	Version           uint8    //NTP版本号：3bit，用来指示使用的NTP版本号
-	Mode              uint8    //模式：3bit，用来指示NTP客户端和服务器之间的交互方式
-	Stratum           uint8    //NTP服务器的级别：8bit，用来指示NTP服务器的级别
-	PollInterval      uint8    //客户端向服务器查询时间的间隔：8bit，用来指示客户端向服务器发送请求的间隔
-	Precision         uint8    //NTP服务器时间的精度：8bit，用来指示NTP服务器时间的精度
-	RootDelay         uint32   //根延迟：32bit，用来指示NTP客户端和服务器之间的延迟
-	RootDisp          uint32   //根分散：32bit，用来指示NTP客户端和服务器之间的时间分散
-	ReferenceID       uint32   //参考标识符：32bit，用来指示参考时钟的标识符
-	RefTimestamp      int64    //参考时间戳：64bit，用来指示服务器的参考时间
-	OrigTimestamp     int64    //发出时间戳：64bit，用来指示客户端发出请求的时间
-	RecvTimestamp     int64    //接收时间戳：64bit，用来指示服务器接收请求的时间
-	TransmitTimestamp int64    //发送时间戳：64bit，用来指示服务器发送响应的时间
-	Auth              [8]uint8 //Authentication字段：64bit，用来验证报文的可靠性
+	LeapIndicator     byte             //跳跃指示器（LeapIndicator）：2bit，指示NTP协议运行的状态，分为正常、提前、延后和未知状态。
+	Version           uint8            //NTP版本号：3bit，用来指示使用的NTP版本号
+	Mode              uint8            //模式：3bit，用来指示NTP客户端和服务器之间的交互方式
+	Stratum           uint8            //NTP服务器的级别：8bit，用来指示NTP服务器的级别
+	PollInterval      int8             //客户端向服务器查询时间的间隔：8bit，用来指示客户端向服务器发送请求的间隔
+	Precision         int8             //NTP服务器时间的精度：8bit，用来指示NTP服务器时间的精度
+	RootDelay         uint32           //根延迟：32bit，用来指示NTP客户端和服务器之间的延迟
+	RootDisp          uint32           //根分散：32bit，用来指示NTP客户端和服务器之间的时间分散
+	ReferenceID       uint32           //参考标识符：32bit，用来指示参考时钟的标识符
+	RefTimestamp      NtpTimestamp     //参考时间戳：64bit，用来指示服务器的参考时间
+	OrigTimestamp     NtpTimestamp     //发出时间戳：64bit，用来指示客户端发出请求的时间
+	RecvTimestamp     NtpTimestamp     //接收时间戳：64bit，用来指示服务器接收请求的时间
+	TransmitTimestamp NtpTimestamp     //发送时间戳：64bit，用来指示服务器发送响应的时间
+	Extensions        []ExtensionField //RFC 7822 扩展字段，可有多个
+	Auth              *MACTrailer      //Key Identifier + Message Digest，nil表示报文不带MAC
 }
 
 // 判断是否为标准NTP请求报文
@@ -169,8 +394,3 @@ func IsStandardNtpRequest(pkt []byte) bool {
 	return true
 	//return (pkt[1] == 3) //pkt[0]=219 二进制为11011011
 }
-
-// 判断是否为Microsoft NTP请求报文
-func IsMicrosoftNtpRequest(pkt []byte) bool {
-	return (pkt[2] == 7)
-}
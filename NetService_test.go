@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientCaptures are requests as sent by real clients, one line per 16
+// bytes: header, reference and origin, receive and transmit.
+var clientCaptures = []struct {
+	name    string
+	hex     string
+	version uint8
+	mode    uint8 //应答模式
+}{
+	{"xntpd NTPv1 mode 0 from ephemeral port", `
+		08020a00 00000a3c 00000d6b c0a80101
+		e8b1e9a0 3d70a3d7 00000000 00000000
+		00000000 00000000 e8b1e9b2 1a9fbe76`, 1, ModeServer},
+	{"ntpdate -o 1", `
+		cb0004fa 00010000 00010000 00000000
+		00000000 00000000 00000000 00000000
+		00000000 00000000 e8b1e9b2 20c49ba5`, 1, ModeServer},
+	{"ntpdate -o 2", `
+		d30004fa 00010000 00010000 00000000
+		00000000 00000000 00000000 00000000
+		00000000 00000000 e8b1e9b2 2d0e5604`, 2, ModeServer},
+	{"SNTP v3 (w32tm)", `
+		1b000000 00000000 00000000 00000000
+		00000000 00000000 00000000 00000000
+		00000000 00000000 e8b1e9b2 3a5e353f`, 3, ModeServer},
+	{"ntpdate 4.2", `
+		e30004fa 00010000 00010000 00000000
+		00000000 00000000 00000000 00000000
+		00000000 00000000 e8b1e9b2 46a7ef9d`, 4, ModeServer},
+	{"chrony 4", `
+		230006e9 00000000 00000000 00000000
+		00000000 00000000 00000000 00000000
+		00000000 00000000 7c2e61b0 9e3b15a4`, 4, ModeServer},
+	{"ntpd symmetric active", `
+		210206e9 00000a3c 00000d6b c0a80101
+		e8b1e9a0 3d70a3d7 e8b1e9a8 0624dd2f
+		e8b1e9a8 0625e4b1 e8b1e9b2 53f7ced9`, 4, ModeSymmetricPassive},
+}
+
+func decodeCapture(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil || len(b) != NtpV4PacketSize {
+		t.Fatalf("bad capture %q: %v", s, err)
+	}
+	return b
+}
+
+// TestReplyVersionAndMode sends captured requests of every version to a
+// loopback server from an ephemeral port and checks the version echo and
+// the reply mode.
+func TestReplyVersionAndMode(t *testing.T) {
+	server := serveNTP(t, &NTPService{})
+	for _, tt := range clientCaptures {
+		req := decodeCapture(t, tt.hex)
+		buf := exchange(t, server, req, time.Second)
+		var resp NTPv4Packet
+		if buf == nil || resp.UnmarshalBinary(buf) != nil {
+			t.Errorf("%s: no valid reply", tt.name)
+			continue
+		}
+		if resp.Version != tt.version || resp.Mode != tt.mode {
+			t.Errorf("%s: reply version %d mode %d, want %d %d", tt.name, resp.Version, resp.Mode, tt.version, tt.mode)
+		}
+		if uint64(resp.OrigTimestamp) != binary.BigEndian.Uint64(req[40:48]) {
+			t.Errorf("%s: origin %v does not echo the request transmit timestamp", tt.name, resp.OrigTimestamp)
+		}
+	}
+}
+
+// TestReplyModeNTPv1 checks that an NTPv1 mode 0 request is answered as a
+// peer when it comes from port 123 and as a client otherwise (RFC 1305
+// appendix B).
+func TestReplyModeNTPv1(t *testing.T) {
+	pkt, err := ParseNTPPacket(decodeCapture(t, clientCaptures[0].hex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		port int
+		mode uint8
+	}{
+		{123, ModeSymmetricPassive},
+		{1023, ModeServer},
+		{50123, ModeServer},
+	} {
+		resp, err := CreateNTPResponse(pkt, tt.port, time.Now(), SystemVars{Stratum: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := resp[0] & 0x07; mode != tt.mode || resp[0]>>3&0x07 != 1 {
+			t.Errorf("port %d: reply %#02x, want version 1 mode %d", tt.port, resp[0], tt.mode)
+		}
+		kod, err := CreateKoDResponse(pkt, tt.port, KissRate, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := kod[0] & 0x07; mode != tt.mode {
+			t.Errorf("port %d: KoD mode %d, want %d", tt.port, mode, tt.mode)
+		}
+	}
+}
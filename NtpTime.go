@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ntpEpochOffset 1900-01-01 到 1970-01-01 的秒数
+	ntpEpochOffset = 2208988800
+	// ntpEraSeconds 一个NTP时代(era)的长度 2^32 秒，第0时代在 2036-02-07 06:28:16 UTC 结束
+	ntpEraSeconds = 1 << 32
+)
+
+// NtpTimestamp is the 64-bit NTP timestamp format: the upper 32 bits are
+// seconds since the start of the current NTP era, the lower 32 bits are the
+// fraction of a second in units of 2^-32 s.
+//
+// NTP时间戳：高32位为秒，低32位为秒的小数部分
+type NtpTimestamp uint64
+
+// NewNtpTimestamp converts a time.Time into an NTP timestamp. The zero
+// time.Time maps to the zero timestamp, which NTP uses for "unknown".
+func NewNtpTimestamp(t time.Time) NtpTimestamp {
+	if t.IsZero() {
+		return 0
+	}
+	secs := uint64(t.Unix()+ntpEpochOffset) & 0xffffffff //只保留era内的秒数，2036年后自动回绕
+	frac := (uint64(t.Nanosecond())<<32 + 500000000) / 1000000000
+	if frac > 0xffffffff {
+		// 四舍五入溢出时保持在同一秒内
+		frac = 0xffffffff
+	}
+	return NtpTimestamp(secs<<32 | frac)
+}
+
+// Seconds returns the seconds part of the timestamp within its era.
+func (ts NtpTimestamp) Seconds() uint32 {
+	return uint32(ts >> 32)
+}
+
+// Fraction returns the fractional-second part in units of 2^-32 s.
+func (ts NtpTimestamp) Fraction() uint32 {
+	return uint32(ts)
+}
+
+// IsZero reports whether the timestamp is the NTP "unknown" value.
+func (ts NtpTimestamp) IsZero() bool {
+	return ts == 0
+}
+
+// Era returns the NTP era the timestamp is assumed to belong to when
+// converted with Time: seconds with the most significant bit set fall in
+// era 0 (1968-2036), the others in era 1 (2036-2104), as in RFC 4330 3.
+func (ts NtpTimestamp) Era() int {
+	if ts.Seconds()&0x80000000 != 0 {
+		return 0
+	}
+	return 1
+}
+
+// Time converts the timestamp to a time.Time using the RFC 4330 era rule.
+func (ts NtpTimestamp) Time() time.Time {
+	if ts.IsZero() {
+		return time.Time{}
+	}
+	return ts.timeInEra(ts.Era())
+}
+
+// TimeNear converts the timestamp to the time.Time closest to pivot, which
+// resolves the era for any date as long as pivot is within 68 years.
+func (ts NtpTimestamp) TimeNear(pivot time.Time) time.Time {
+	if ts.IsZero() {
+		return time.Time{}
+	}
+	pivotSecs := pivot.Unix() + ntpEpochOffset
+	era := pivotSecs >> 32
+	if pivotSecs < 0 {
+		era = -((-pivotSecs + ntpEraSeconds - 1) >> 32)
+	}
+	// 以pivot所在时代为中心，选择离pivot最近的时代
+	best := ts.timeInEra(int(era))
+	for _, e := range []int{int(era) - 1, int(era) + 1} {
+		t := ts.timeInEra(e)
+		if absDuration(t.Sub(pivot)) < absDuration(best.Sub(pivot)) {
+			best = t
+		}
+	}
+	return best
+}
+
+func (ts NtpTimestamp) timeInEra(era int) time.Time {
+	secs := int64(era)*ntpEraSeconds + int64(ts.Seconds()) - ntpEpochOffset
+	nsec := (uint64(ts.Fraction())*1000000000 + 1<<31) >> 32
+	return time.Unix(secs, int64(nsec)).UTC()
+}
+
+// String formats the timestamp like ntpq does: hex seconds.fraction plus the
+// UTC time it represents.
+func (ts NtpTimestamp) String() string {
+	return fmt.Sprintf("%08x.%08x %s", ts.Seconds(), ts.Fraction(), ts.Time().Format(time.RFC3339Nano))
+}
+
+// DurationToNtpShort converts a non-negative duration to the 32-bit NTP
+// short format (16 bits seconds, 16 bits fraction) used by root delay and
+// root dispersion. Values that do not fit are clamped.
+func DurationToNtpShort(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	if d >= 1<<16*time.Second {
+		return 0xffffffff //先截断，否则左移16位会溢出uint64
+	}
+	return uint32((uint64(d) << 16) / uint64(time.Second))
+}
+
+// NtpShortToDuration converts the 32-bit NTP short format to a duration.
+func NtpShortToDuration(v uint32) time.Duration {
+	return time.Duration((uint64(v) * uint64(time.Second)) >> 16)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// eraOneStart is where the 32-bit NTP seconds wrap (RFC 5905 6).
+var eraOneStart = time.Date(2036, 2, 7, 6, 28, 16, 0, time.UTC)
+
+func TestNtpTimestampEras(t *testing.T) {
+	tests := []struct {
+		name string
+		t    time.Time
+		secs uint32
+		era  int
+	}{
+		{"unix epoch", time.Unix(0, 0).UTC(), ntpEpochOffset, 0},
+		{"2024", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), 3918283200, 0},
+		{"last second of era 0", eraOneStart.Add(-time.Second), 0xffffffff, 0},
+		{"first second of era 1", eraOneStart.Add(time.Second), 1, 1},
+		{"2100", time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), 2016466304, 1},
+	}
+	for _, tt := range tests {
+		ts := NewNtpTimestamp(tt.t)
+		if ts.Seconds() != tt.secs || ts.Era() != tt.era {
+			t.Errorf("%s: seconds %d era %d, want %d %d", tt.name, ts.Seconds(), ts.Era(), tt.secs, tt.era)
+		}
+		if got := ts.Time(); !got.Equal(tt.t) {
+			t.Errorf("%s: Time() %v, want %v", tt.name, got, tt.t)
+		}
+		if got := ts.TimeNear(tt.t.Add(time.Hour)); !got.Equal(tt.t) {
+			t.Errorf("%s: TimeNear() %v, want %v", tt.name, got, tt.t)
+		}
+	}
+
+	// 跨越era边界时由pivot决定所在的时代
+	before, after := NewNtpTimestamp(eraOneStart.Add(-time.Second)), NewNtpTimestamp(eraOneStart.Add(time.Second))
+	if got := before.TimeNear(eraOneStart.Add(time.Minute)); !got.Equal(eraOneStart.Add(-time.Second)) {
+		t.Errorf("end of era 0 seen from era 1: %v", got)
+	}
+	if got := after.TimeNear(eraOneStart.Add(-time.Minute)); !got.Equal(eraOneStart.Add(time.Second)) {
+		t.Errorf("start of era 1 seen from era 0: %v", got)
+	}
+	// 1968-01-20之前的秒数最高位为0，Time()按RFC 4330规则归入era 1，TimeNear按pivot得到era 0
+	early := time.Date(1968, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := NewNtpTimestamp(early).TimeNear(time.Unix(0, 0)); !got.Equal(early) {
+		t.Errorf("1968 seen from 1970: %v", got)
+	}
+	if !NewNtpTimestamp(time.Time{}).IsZero() || !NtpTimestamp(0).Time().IsZero() || !NtpTimestamp(0).TimeNear(eraOneStart).IsZero() {
+		t.Error("zero time and zero timestamp do not map to each other")
+	}
+}
+
+func TestNtpTimestampFraction(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		nsec int
+		frac uint32
+	}{
+		{0, 0},
+		{1, 4}, //4.29 舍入为4
+		{250000000, 0x40000000},
+		{500000000, 0x80000000},
+		{999999999, 0xfffffffc},
+	}
+	for _, tt := range tests {
+		ts := NewNtpTimestamp(base.Add(time.Duration(tt.nsec)))
+		if ts.Fraction() != tt.frac || ts.Seconds() != NewNtpTimestamp(base).Seconds() {
+			t.Errorf("%dns: %08x.%08x, want fraction %08x in the same second", tt.nsec, ts.Seconds(), ts.Fraction(), tt.frac)
+		}
+	}
+	// 2^-32秒的分辨率高于纳秒，往返换算不丢失精度
+	for nsec := 0; nsec < 1e9; nsec += 999983 {
+		want := base.Add(time.Duration(nsec))
+		if got := NewNtpTimestamp(want).Time(); !got.Equal(want) {
+			t.Fatalf("%dns: round trip gives %v", nsec, got)
+		}
+	}
+}
+
+func TestNtpShortFormat(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want uint32
+	}{
+		{-time.Second, 0},
+		{0, 0},
+		{time.Second, 0x00010000},
+		{1500 * time.Millisecond, 0x00018000},
+		{65535 * time.Second, 0xffff0000},
+		{1<<16*time.Second - time.Nanosecond, 0xffffffff},
+		{1 << 16 * time.Second, 0xffffffff},
+		{100 * time.Hour, 0xffffffff}, //左移16位会溢出uint64
+		{math.MaxInt64, 0xffffffff},
+	}
+	for _, tt := range tests {
+		if got := DurationToNtpShort(tt.d); got != tt.want {
+			t.Errorf("DurationToNtpShort(%v) = %08x, want %08x", tt.d, got, tt.want)
+		}
+	}
+	for _, d := range []time.Duration{time.Millisecond, 3 * time.Millisecond, 1234567 * time.Microsecond} {
+		if got := NtpShortToDuration(DurationToNtpShort(d)); absDuration(got-d) > time.Second>>16 {
+			t.Errorf("%v round trips to %v", d, got)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NTS extension field types (RFC 8915 5.7)
+const (
+	ExtNtsUniqueIdentifier  uint16 = 0x0104 //Unique Identifier 防重放
+	ExtNtsCookie            uint16 = 0x0204 //NTS Cookie
+	ExtNtsCookiePlaceholder uint16 = 0x0304 //Cookie占位，请求更多cookie
+	ExtNtsAuthenticator     uint16 = 0x0404 //Authenticator and Encrypted Extension Fields
+)
+
+const (
+	ntsCookieKeyIDLength = 4
+	ntsCookieHeader      = 4 //cookie明文头部：AEAD算法2字节 + 保留2字节
+	ntsCookieLength      = ntsCookieKeyIDLength + sivNonceSize + sivTagSize + ntsCookieHeader + 2*sivKeySize
+	ntsMaxNewCookies     = 8  //一次响应最多发放的cookie数量
+	ntsKeptMasterKeys    = 3  //轮换后保留的旧主密钥数量，旧cookie在此期间仍可用
+	minNtsUniqueIDLength = 32 //RFC 8915 5.3 Unique Identifier至少32字节
+)
+
+var (
+	// ErrNtsCookie is returned when a cookie cannot be decrypted, e.g.
+	// because its master key has been rotated out. The server answers
+	// with an NTS NAK.
+	ErrNtsCookie = errors.New("nts: invalid or expired cookie")
+	// ErrNtsRequest is returned for NTS requests that are malformed or
+	// fail authentication; they are dropped silently.
+	ErrNtsRequest = errors.New("nts: malformed or unauthenticated request")
+)
+
+// ntsKeys are the keys exported from an NTS-KE session.
+type ntsKeys struct {
+	aead uint16
+	c2s  []byte //client-to-server 客户端请求认证密钥
+	s2c  []byte //server-to-client 服务端响应加密密钥
+}
+
+// NtsCookieJar encrypts the per-client NTS keys into cookies under a
+// server master key. Master keys can be rotated; cookies made under the
+// last few keys stay valid.
+type NtsCookieJar struct {
+	mu      sync.RWMutex
+	keys    map[uint32][]byte //key ID -> master key
+	order   []uint32          //从旧到新
+	current uint32
+}
+
+// NewNtsCookieJar returns a cookie jar with a fresh random master key.
+func NewNtsCookieJar() (*NtsCookieJar, error) {
+	j := &NtsCookieJar{keys: make(map[uint32][]byte)}
+	if err := j.Rotate(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Rotate makes a new random master key current and discards the oldest
+// one once more than ntsKeptMasterKeys are held.
+func (j *NtsCookieJar) Rotate() error {
+	var id [ntsCookieKeyIDLength]byte
+	key := make([]byte, sivKeySize)
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	keyID := binary.BigEndian.Uint32(id[:])
+	j.keys[keyID] = key
+	j.order = append(j.order, keyID)
+	j.current = keyID
+	for len(j.order) > ntsKeptMasterKeys {
+		delete(j.keys, j.order[0])
+		j.order = j.order[1:]
+	}
+	return nil
+}
+
+// RotateEvery rotates the master key periodically until stop is closed.
+func (j *NtsCookieJar) RotateEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.Rotate(); err != nil {
+				fmt.Println("NTS master key rotation failed:", err)
+				continue
+			}
+			fmt.Println("NTS cookie master key rotated")
+		case <-stop:
+			return
+		}
+	}
+}
+
+// makeCookie encrypts keys into a cookie:
+//
+//	key ID(4) || nonce(16) || SIV(aead(2) || reserved(2) || c2s || s2c)
+//
+// The reserved bytes keep the cookie a multiple of four so it fits an
+// extension field without padding.
+func (j *NtsCookieJar) makeCookie(keys ntsKeys) ([]byte, error) {
+	j.mu.RLock()
+	keyID, master := j.current, j.keys[j.current]
+	j.mu.RUnlock()
+	aead, err := newSivAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	cookie := make([]byte, ntsCookieKeyIDLength+sivNonceSize)
+	binary.BigEndian.PutUint32(cookie, keyID)
+	if _, err := rand.Read(cookie[ntsCookieKeyIDLength:]); err != nil {
+		return nil, err
+	}
+	plain := make([]byte, ntsCookieHeader, ntsCookieHeader+len(keys.c2s)+len(keys.s2c))
+	binary.BigEndian.PutUint16(plain, keys.aead)
+	plain = append(append(plain, keys.c2s...), keys.s2c...)
+	return aead.Seal(cookie, cookie[ntsCookieKeyIDLength:], plain, cookie[:ntsCookieKeyIDLength]), nil
+}
+
+// openCookie recovers the keys from a cookie.
+func (j *NtsCookieJar) openCookie(cookie []byte) (ntsKeys, error) {
+	if len(cookie) != ntsCookieLength {
+		return ntsKeys{}, ErrNtsCookie
+	}
+	j.mu.RLock()
+	master, ok := j.keys[binary.BigEndian.Uint32(cookie)]
+	j.mu.RUnlock()
+	if !ok {
+		return ntsKeys{}, ErrNtsCookie
+	}
+	aead, err := newSivAEAD(master)
+	if err != nil {
+		return ntsKeys{}, err
+	}
+	nonce := cookie[ntsCookieKeyIDLength : ntsCookieKeyIDLength+sivNonceSize]
+	plain, err := aead.Open(nil, nonce, cookie[ntsCookieKeyIDLength+sivNonceSize:], cookie[:ntsCookieKeyIDLength])
+	if err != nil {
+		return ntsKeys{}, ErrNtsCookie
+	}
+	keys := ntsKeys{aead: binary.BigEndian.Uint16(plain)}
+	if keys.aead != AeadAesSivCmac256 {
+		return ntsKeys{}, ErrNtsCookie
+	}
+	keys.c2s = plain[ntsCookieHeader : ntsCookieHeader+sivKeySize]
+	keys.s2c = plain[ntsCookieHeader+sivKeySize:]
+	return keys, nil
+}
+
+// ntsRequest is an authenticated NTS request waiting for its response.
+type ntsRequest struct {
+	uniqueID     []byte
+	keys         ntsKeys
+	placeholders int
+}
+
+// IsNtsRequest reports whether pkt carries an NTS cookie.
+func IsNtsRequest(pkt *NTPv4Packet) bool {
+	_, ok := pkt.Extension(ExtNtsCookie)
+	return ok
+}
+
+// OpenRequest validates the NTS extension fields of a client request in
+// buf. When the cookie is unusable it returns ErrNtsCookie together with
+// the request so that an NTS NAK echoing the Unique Identifier can be sent.
+func (j *NtsCookieJar) OpenRequest(buf []byte, pkt *NTPv4Packet) (*ntsRequest, error) {
+	if pkt.Mode != ModeClient || pkt.Auth != nil || len(pkt.Extensions) == 0 {
+		return nil, ErrNtsRequest
+	}
+	req := &ntsRequest{}
+	var cookie []byte
+	cookies := 0
+	for i, ext := range pkt.Extensions {
+		switch ext.Type {
+		case ExtNtsUniqueIdentifier:
+			req.uniqueID = ext.Value
+		case ExtNtsCookie:
+			cookie = ext.Value
+			cookies++
+		case ExtNtsCookiePlaceholder:
+			req.placeholders++
+		case ExtNtsAuthenticator:
+			if i != len(pkt.Extensions)-1 {
+				return nil, ErrNtsRequest //Authenticator必须是最后一个扩展字段
+			}
+		}
+	}
+	auth := pkt.Extensions[len(pkt.Extensions)-1]
+	if len(req.uniqueID) < minNtsUniqueIDLength || cookies != 1 || auth.Type != ExtNtsAuthenticator {
+		return nil, ErrNtsRequest
+	}
+	keys, err := j.openCookie(cookie)
+	if err != nil {
+		return req, err
+	}
+	req.keys = keys
+
+	nonce, ciphertext, err := parseNtsAuthenticator(auth.Value)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newSivAEAD(keys.c2s)
+	if err != nil {
+		return nil, err
+	}
+	signed := buf[:len(buf)-extFieldHeaderLength-len(auth.Value)] //认证覆盖Authenticator之前的全部内容
+	if _, err := aead.Open(nil, nonce, ciphertext, signed); err != nil {
+		return nil, ErrNtsRequest
+	}
+	return req, nil
+}
+
+// Seal appends the Unique Identifier and an Authenticator carrying fresh
+// cookies to an encoded response whose Transmit Timestamp is already set.
+func (j *NtsCookieJar) Seal(resp []byte, req *ntsRequest) ([]byte, error) {
+	resp = appendExtensions(resp, []ExtensionField{{Type: ExtNtsUniqueIdentifier, Value: req.uniqueID}}, true)
+
+	n := 1 + req.placeholders
+	if n > ntsMaxNewCookies {
+		n = ntsMaxNewCookies
+	}
+	cookies := make([]ExtensionField, 0, n)
+	for i := 0; i < n; i++ {
+		cookie, err := j.makeCookie(req.keys)
+		if err != nil {
+			return nil, err
+		}
+		cookies = append(cookies, ExtensionField{Type: ExtNtsCookie, Value: cookie})
+	}
+	plain := appendExtensions(nil, cookies, true)
+
+	aead, err := newSivAEAD(req.keys.s2c)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, sivNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ciphertext := aead.Seal(nil, nonce, plain, resp)
+	auth := ExtensionField{Type: ExtNtsAuthenticator, Value: buildNtsAuthenticator(nonce, ciphertext)}
+	return appendExtensions(resp, []ExtensionField{auth}, false), nil
+}
+
+// AppendNtsNak appends the Unique Identifier to an NTS NAK (a kiss-o'-death
+// response with code NTSN) so the client can match it to its request.
+func AppendNtsNak(resp []byte, req *ntsRequest) []byte {
+	return appendExtensions(resp, []ExtensionField{{Type: ExtNtsUniqueIdentifier, Value: req.uniqueID}}, false)
+}
+
+// Authenticator body: Nonce Length(16) Ciphertext Length(16) Nonce Ciphertext，各自按4字节补齐
+func parseNtsAuthenticator(body []byte) (nonce, ciphertext []byte, err error) {
+	if len(body) < 4 {
+		return nil, nil, ErrNtsRequest
+	}
+	nonceLen := int(binary.BigEndian.Uint16(body[0:2]))
+	cipherLen := int(binary.BigEndian.Uint16(body[2:4]))
+	nonceEnd := 4 + (nonceLen+3)&^3
+	if nonceLen == 0 || nonceEnd+cipherLen > len(body) {
+		return nil, nil, ErrNtsRequest
+	}
+	return body[4 : 4+nonceLen], body[nonceEnd : nonceEnd+cipherLen], nil
+}
+
+func buildNtsAuthenticator(nonce, ciphertext []byte) []byte {
+	nonceLen := (len(nonce) + 3) &^ 3
+	body := make([]byte, 4+nonceLen+(len(ciphertext)+3)&^3)
+	binary.BigEndian.PutUint16(body[0:2], uint16(len(nonce)))
+	binary.BigEndian.PutUint16(body[2:4], uint16(len(ciphertext)))
+	copy(body[4:], nonce)
+	copy(body[4+nonceLen:], ciphertext)
+	return body
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// NTS-KE record types (RFC 8915 4)
+const (
+	ntskeEndOfMessage    uint16 = 0
+	ntskeNextProtocol    uint16 = 1
+	ntskeError           uint16 = 2
+	ntskeWarning         uint16 = 3
+	ntskeAeadAlgorithm   uint16 = 4
+	ntskeNewCookie       uint16 = 5
+	ntskeServer          uint16 = 6
+	ntskePort            uint16 = 7
+	ntskeCriticalBit     uint16 = 0x8000
+	ntskeProtocolNTPv4   uint16 = 0
+	ntskeErrUnrecognized uint16 = 0 //Unrecognized Critical Record
+	ntskeErrBadRequest   uint16 = 1 //Bad Request
+	ntskeErrInternal     uint16 = 2 //Internal Server Error
+)
+
+const (
+	NtsKePort          = 4460
+	ntskeALPN          = "ntske/1"
+	ntskeExporterLabel = "EXPORTER-network-time-security"
+	ntskeMaxRequest    = 1024 //NTS-KE请求最大长度
+	ntskeTimeout       = 10 * time.Second
+	ntskeCookieCount   = 8 //握手时发放的cookie数量
+)
+
+// NtsKeServer is the NTS Key Establishment server: a TLS 1.3 listener that
+// negotiates NTPv4 with AEAD_AES_SIV_CMAC_256 and hands out cookies.
+type NtsKeServer struct {
+	Addr    string        //监听地址 默认 ":4460"
+	TLS     *tls.Config   //证书配置
+	Cookies *NtsCookieJar //与UDP端共享的cookie主密钥
+	NTPHost string        //NTPv4 Server Negotiation，空表示与NTS-KE同一主机
+	NTPPort uint16        //NTPv4 Port Negotiation，0表示123
+}
+
+type ntskeRecord struct {
+	critical bool
+	typ      uint16
+	body     []byte
+}
+
+// ListenAndServe listens on Addr and serves NTS-KE until the listener fails.
+func (s *NtsKeServer) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", NtsKePort)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Println("Listening for NTS-KE on", ln.Addr())
+	return s.Serve(ln)
+}
+
+// Serve runs TLS over the TCP listener ln and accepts NTS-KE connections
+// until it fails.
+func (s *NtsKeServer) Serve(ln net.Listener) error {
+	cfg := s.TLS.Clone()
+	cfg.MinVersion = tls.VersionTLS13
+	cfg.NextProtos = []string{ntskeALPN}
+	ln = tls.NewListener(ln, cfg)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn.(*tls.Conn))
+	}
+}
+
+func (s *NtsKeServer) serve(conn *tls.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntskeTimeout))
+	if err := conn.Handshake(); err != nil {
+		fmt.Println("NTS-KE handshake failed:", conn.RemoteAddr(), err)
+		return
+	}
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != ntskeALPN {
+		fmt.Println("NTS-KE client did not negotiate", ntskeALPN, conn.RemoteAddr())
+		return
+	}
+	records, err := readNtskeRecords(io.LimitReader(conn, ntskeMaxRequest))
+	var resp []byte
+	if err != nil {
+		fmt.Println("NTS-KE bad request:", conn.RemoteAddr(), err)
+		resp = ntskeErrorResponse(ntskeErrBadRequest)
+	} else {
+		resp = s.respond(records, &state)
+	}
+	if _, err := conn.Write(resp); err != nil {
+		fmt.Println("NTS-KE write failed:", conn.RemoteAddr(), err)
+	}
+}
+
+// respond builds the server's record sequence for a valid client request.
+func (s *NtsKeServer) respond(records []ntskeRecord, state *tls.ConnectionState) []byte {
+	var protocols, aeads []uint16
+	for _, rec := range records {
+		switch rec.typ {
+		case ntskeNextProtocol:
+			protocols = append(protocols, uint16List(rec.body)...)
+		case ntskeAeadAlgorithm:
+			aeads = append(aeads, uint16List(rec.body)...)
+		case ntskeEndOfMessage, ntskeServer, ntskePort:
+		default:
+			if rec.critical {
+				return ntskeErrorResponse(ntskeErrUnrecognized)
+			}
+		}
+	}
+	if protocols == nil {
+		return ntskeErrorResponse(ntskeErrBadRequest)
+	}
+
+	var out []byte
+	if !containsUint16(protocols, ntskeProtocolNTPv4) {
+		// 没有共同支持的协议：返回空的Next Protocol记录
+		out = appendNtskeRecord(out, true, ntskeNextProtocol, nil)
+		return appendNtskeRecord(out, true, ntskeEndOfMessage, nil)
+	}
+	out = appendNtskeRecord(out, true, ntskeNextProtocol, uint16Bytes(ntskeProtocolNTPv4))
+	if !containsUint16(aeads, AeadAesSivCmac256) {
+		out = appendNtskeRecord(out, true, ntskeAeadAlgorithm, nil)
+		return appendNtskeRecord(out, true, ntskeEndOfMessage, nil)
+	}
+	out = appendNtskeRecord(out, true, ntskeAeadAlgorithm, uint16Bytes(AeadAesSivCmac256))
+
+	keys, err := exportNtsKeys(state, ntskeProtocolNTPv4, AeadAesSivCmac256)
+	if err != nil {
+		fmt.Println("NTS-KE key export failed:", err)
+		return ntskeErrorResponse(ntskeErrInternal)
+	}
+	for i := 0; i < ntskeCookieCount; i++ {
+		cookie, err := s.Cookies.makeCookie(keys)
+		if err != nil {
+			fmt.Println("NTS-KE cookie generation failed:", err)
+			return ntskeErrorResponse(ntskeErrInternal)
+		}
+		out = appendNtskeRecord(out, false, ntskeNewCookie, cookie)
+	}
+	if s.NTPHost != "" {
+		out = appendNtskeRecord(out, true, ntskeServer, []byte(s.NTPHost))
+	}
+	if s.NTPPort != 0 {
+		out = appendNtskeRecord(out, true, ntskePort, uint16Bytes(s.NTPPort))
+	}
+	return appendNtskeRecord(out, true, ntskeEndOfMessage, nil)
+}
+
+// exportNtsKeys derives the C2S and S2C keys from the TLS session (RFC 8915 5.1).
+func exportNtsKeys(state *tls.ConnectionState, protocol, aead uint16) (ntsKeys, error) {
+	context := make([]byte, 5)
+	binary.BigEndian.PutUint16(context[0:2], protocol)
+	binary.BigEndian.PutUint16(context[2:4], aead)
+	c2s, err := state.ExportKeyingMaterial(ntskeExporterLabel, context, sivKeySize)
+	if err != nil {
+		return ntsKeys{}, err
+	}
+	context[4] = 1
+	s2c, err := state.ExportKeyingMaterial(ntskeExporterLabel, context, sivKeySize)
+	if err != nil {
+		return ntsKeys{}, err
+	}
+	return ntsKeys{aead: aead, c2s: c2s, s2c: s2c}, nil
+}
+
+// readNtskeRecords reads records up to and including End of Message.
+func readNtskeRecords(r io.Reader) ([]ntskeRecord, error) {
+	var records []ntskeRecord
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		typ := binary.BigEndian.Uint16(hdr[0:2])
+		body := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		rec := ntskeRecord{critical: typ&ntskeCriticalBit != 0, typ: typ &^ ntskeCriticalBit, body: body}
+		records = append(records, rec)
+		if rec.typ == ntskeEndOfMessage {
+			if len(body) != 0 {
+				return nil, errors.New("nts-ke: End of Message with body")
+			}
+			return records, nil
+		}
+	}
+}
+
+func appendNtskeRecord(out []byte, critical bool, typ uint16, body []byte) []byte {
+	if critical {
+		typ |= ntskeCriticalBit
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint16(hdr[0:2], typ)
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(body)))
+	return append(append(out, hdr[:]...), body...)
+}
+
+func ntskeErrorResponse(code uint16) []byte {
+	out := appendNtskeRecord(nil, true, ntskeError, uint16Bytes(code))
+	return appendNtskeRecord(out, true, ntskeEndOfMessage, nil)
+}
+
+func uint16List(b []byte) []uint16 {
+	list := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		list = append(list, binary.BigEndian.Uint16(b[i:i+2]))
+	}
+	return list
+}
+
+func uint16Bytes(v uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return b[:]
+}
+
+func containsUint16(list []uint16, v uint16) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateSelfSignedCert creates an ECDSA P-256 certificate for hosts,
+// valid for one year, for testing NTS locally.
+func GenerateSelfSignedCert(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+var loopback = net.IPv4(127, 0, 0, 1)
+
+// serveNTP answers requests to ntp on an ephemeral loopback port, passing
+// client requests to the MS-SNTP or standard handler the way the main loop
+// does.
+func serveNTP(t *testing.T, ntp *NTPService) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			recvTime := ntp.Now()
+			if err != nil {
+				return
+			}
+			if ntp.MsSntp != nil && IsMicrosoftNtpRequest(buf[:n]) {
+				ntp.HandleMicrosoftNTPServer(buf[:n], conn, addr, recvTime)
+				continue
+			}
+			ntp.HandleStanderNTPServer(buf[:n], conn, addr, recvTime)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// exchange sends req to server and returns the reply, or nil when none
+// arrives within wait.
+func exchange(t *testing.T, server *net.UDPAddr, req []byte, wait time.Duration) []byte {
+	t.Helper()
+	conn, err := net.DialUDP("udp4", nil, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, MaxPacketSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+// ntskeHandshake runs NTS-KE against addr and returns the exported keys and
+// the cookies handed out.
+func ntskeHandshake(t *testing.T, addr string, roots *x509.CertPool) (ntsKeys, [][]byte) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:    roots,
+		NextProtos: []string{ntskeALPN},
+		MinVersion: tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var req []byte
+	req = appendNtskeRecord(req, true, ntskeNextProtocol, uint16Bytes(ntskeProtocolNTPv4))
+	req = appendNtskeRecord(req, true, ntskeAeadAlgorithm, uint16Bytes(AeadAesSivCmac256))
+	req = appendNtskeRecord(req, true, ntskeEndOfMessage, nil)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	records, err := readNtskeRecords(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cookies [][]byte
+	for _, rec := range records {
+		switch rec.typ {
+		case ntskeError:
+			t.Fatalf("NTS-KE error %x", rec.body)
+		case ntskeNextProtocol:
+			if !bytes.Equal(rec.body, uint16Bytes(ntskeProtocolNTPv4)) {
+				t.Fatalf("next protocol %x", rec.body)
+			}
+		case ntskeAeadAlgorithm:
+			if !bytes.Equal(rec.body, uint16Bytes(AeadAesSivCmac256)) {
+				t.Fatalf("AEAD %x", rec.body)
+			}
+		case ntskeNewCookie:
+			cookies = append(cookies, rec.body)
+		}
+	}
+	state := conn.ConnectionState()
+	keys, err := exportNtsKeys(&state, ntskeProtocolNTPv4, AeadAesSivCmac256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys, cookies
+}
+
+// ntsClientRequest builds an NTS-protected client request.
+func ntsClientRequest(t *testing.T, keys ntsKeys, cookie, uid []byte, xmt NtpTimestamp) []byte {
+	t.Helper()
+	req, err := NewPacketBuilder().Mode(ModeClient).Transmit(xmt).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = appendExtensions(req, []ExtensionField{
+		{Type: ExtNtsUniqueIdentifier, Value: uid},
+		{Type: ExtNtsCookie, Value: cookie},
+	}, true)
+	aead, err := newSivAEAD(keys.c2s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, sivNonceSize)
+	rand.Read(nonce)
+	auth := buildNtsAuthenticator(nonce, aead.Seal(nil, nonce, nil, req))
+	return appendExtensions(req, []ExtensionField{{Type: ExtNtsAuthenticator, Value: auth}}, false)
+}
+
+// TestNtsLoopback runs NTS-KE over TLS with a self-signed certificate and
+// then an NTS-protected time request, both on 127.0.0.1.
+func TestNtsLoopback(t *testing.T) {
+	cert, err := GenerateSelfSignedCert("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	jar, err := NewNtsCookieJar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ke := &NtsKeServer{TLS: &tls.Config{Certificates: []tls.Certificate{cert}}, Cookies: jar}
+	go ke.Serve(ln)
+	server := serveNTP(t, &NTPService{NTS: jar})
+
+	keys, cookies := ntskeHandshake(t, ln.Addr().String(), roots)
+	if len(cookies) != ntskeCookieCount {
+		t.Fatalf("got %d cookies, want %d", len(cookies), ntskeCookieCount)
+	}
+
+	uid := make([]byte, minNtsUniqueIDLength)
+	rand.Read(uid)
+	xmt := NewNtpTimestamp(time.Now())
+	buf := exchange(t, server, ntsClientRequest(t, keys, cookies[0], uid, xmt), time.Second)
+	if buf == nil {
+		t.Fatal("no reply to NTS request")
+	}
+	var resp NTPv4Packet
+	if err := resp.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Mode != ModeServer || resp.OrigTimestamp != xmt {
+		t.Fatalf("mode %d origin %v, want mode 4 origin %v", resp.Mode, resp.OrigTimestamp, xmt)
+	}
+	if ext, ok := resp.Extension(ExtNtsUniqueIdentifier); !ok || !bytes.Equal(ext.Value, uid) {
+		t.Fatal("Unique Identifier not echoed")
+	}
+	auth := resp.Extensions[len(resp.Extensions)-1]
+	if auth.Type != ExtNtsAuthenticator {
+		t.Fatalf("last extension %#04x, want Authenticator", auth.Type)
+	}
+	nonce, ciphertext, err := parseNtsAuthenticator(auth.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := newSivAEAD(keys.s2c)
+	plain, err := aead.Open(nil, nonce, ciphertext, buf[:len(buf)-extFieldHeaderLength-len(auth.Value)])
+	if err != nil {
+		t.Fatal("response authenticator:", err)
+	}
+	fresh, _, err := parseTrailer(4, plain)
+	if err != nil || len(fresh) != 1 || fresh[0].Type != ExtNtsCookie {
+		t.Fatalf("encrypted fields %+v, %v; want one cookie", fresh, err)
+	}
+
+	// 新发放的cookie可以直接使用
+	if exchange(t, server, ntsClientRequest(t, keys, fresh[0].Value, uid, xmt), time.Second) == nil {
+		t.Error("no reply with a cookie from the previous response")
+	}
+	// 用错误的密钥认证的请求被静默丢弃
+	wrong := ntsKeys{aead: keys.aead, c2s: keys.s2c, s2c: keys.c2s}
+	if exchange(t, server, ntsClientRequest(t, wrong, cookies[1], uid, xmt), 200*time.Millisecond) != nil {
+		t.Error("reply to a request with a bad authenticator")
+	}
+}
+
+// TestNtsNakAfterRotation checks that a cookie whose master key has been
+// rotated out gets an NTS NAK echoing the Unique Identifier.
+func TestNtsNakAfterRotation(t *testing.T) {
+	jar, err := NewNtsCookieJar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := ntsKeys{aead: AeadAesSivCmac256, c2s: make([]byte, sivKeySize), s2c: make([]byte, sivKeySize)}
+	cookie, err := jar.makeCookie(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < ntsKeptMasterKeys; i++ {
+		jar.Rotate()
+	}
+	server := serveNTP(t, &NTPService{NTS: jar})
+
+	uid := bytes.Repeat([]byte{0x5a}, minNtsUniqueIDLength)
+	buf := exchange(t, server, ntsClientRequest(t, keys, cookie, uid, NewNtpTimestamp(time.Now())), time.Second)
+	if buf == nil {
+		t.Fatal("no NTS NAK")
+	}
+	var resp NTPv4Packet
+	if err := resp.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Stratum != 0 || resp.KissCode() != KissNtsNak {
+		t.Errorf("stratum %d kiss %q, want 0 %q", resp.Stratum, resp.KissCode(), KissNtsNak)
+	}
+	if ext, ok := resp.Extension(ExtNtsUniqueIdentifier); !ok || !bytes.Equal(ext.Value, uid) {
+		t.Error("Unique Identifier not echoed in NAK")
+	}
+	if _, ok := resp.Extension(ExtNtsAuthenticator); ok {
+		t.Error("NAK carries an Authenticator")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// NTP association modes (RFC 5905 figure 10)
+const (
+	ModeReserved         uint8 = 0 //保留 NTPv1客户端请求使用
+	ModeSymmetricActive  uint8 = 1 //主动对等体
+	ModeSymmetricPassive uint8 = 2 //被动对等体
+	ModeClient           uint8 = 3 //客户端
+	ModeServer           uint8 = 4 //服务端
+	ModeBroadcast        uint8 = 5 //广播
+	ModeControl          uint8 = 6 //NTP控制报文 ntpq
+	ModePrivate          uint8 = 7 //私有 ntpdc 不支持
+)
+
+// Leap indicator values
+const (
+	LeapNoWarning   uint8 = 0 //无警告
+	LeapAddSecond   uint8 = 1 //当月最后一分钟为61秒
+	LeapDelSecond   uint8 = 2 //当月最后一分钟为59秒
+	LeapNotInSync   uint8 = 3 //时钟未同步
+	minNtpVersion   uint8 = 1
+	maxNtpVersion   uint8 = 4
+	ntpHeaderLength       = NtpV4PacketSize
+)
+
+// PacketLengthError is returned for packets shorter than the 48-byte header
+// or not a whole number of 32-bit words.
+type PacketLengthError struct {
+	Length int
+}
+
+func (e *PacketLengthError) Error() string {
+	return fmt.Sprintf("ntp: bad packet length %d, need at least %d bytes in 32-bit words", e.Length, ntpHeaderLength)
+}
+
+// PacketVersionError is returned for version numbers outside 1-4.
+type PacketVersionError struct {
+	Version uint8
+}
+
+func (e *PacketVersionError) Error() string {
+	return fmt.Sprintf("ntp: unsupported version %d", e.Version)
+}
+
+// PacketModeError is returned for modes that are not valid for the version,
+// such as mode 0 outside NTPv1 or the private mode 7.
+type PacketModeError struct {
+	Version uint8
+	Mode    uint8
+}
+
+func (e *PacketModeError) Error() string {
+	return fmt.Sprintf("ntp: invalid mode %d for version %d", e.Mode, e.Version)
+}
+
+func validateVersionMode(version, mode uint8) error {
+	if version < minNtpVersion || version > maxNtpVersion {
+		return &PacketVersionError{Version: version}
+	}
+	if mode >= ModePrivate || (mode == ModeReserved && version != 1) {
+		return &PacketModeError{Version: version, Mode: mode}
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. Decoding the result
+// with UnmarshalBinary yields an identical packet, except that extension
+// values come back with the zero padding added on encoding: a value is only
+// returned unchanged when its field is already a multiple of four bytes and
+// at least the RFC 7822 minimum length. A MAC whose digest is not 0, 16 or
+// 20 bytes cannot be decoded and is rejected.
+func (pkt *NTPv4Packet) MarshalBinary() ([]byte, error) {
+	if pkt.LeapIndicator > LeapNotInSync {
+		return nil, fmt.Errorf("ntp: invalid leap indicator %d", pkt.LeapIndicator)
+	}
+	if err := validateVersionMode(pkt.Version, pkt.Mode); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, ntpHeaderLength)
+	//buf[0] aabbbccc: aa=LI bbb=VN ccc=Mode
+	buf[0] = pkt.LeapIndicator<<6 | pkt.Version<<3 | pkt.Mode
+	buf[1] = pkt.Stratum
+	buf[2] = uint8(pkt.PollInterval)
+	buf[3] = uint8(pkt.Precision)
+	binary.BigEndian.PutUint32(buf[4:8], pkt.RootDelay)
+	binary.BigEndian.PutUint32(buf[8:12], pkt.RootDisp)
+	binary.BigEndian.PutUint32(buf[12:16], pkt.ReferenceID)
+	binary.BigEndian.PutUint64(buf[16:24], uint64(pkt.RefTimestamp))
+	binary.BigEndian.PutUint64(buf[24:32], uint64(pkt.OrigTimestamp))
+	binary.BigEndian.PutUint64(buf[32:40], uint64(pkt.RecvTimestamp))
+	binary.BigEndian.PutUint64(buf[40:48], uint64(pkt.TransmitTimestamp))
+	if len(pkt.Extensions) > 0 && pkt.Version != 4 {
+		return nil, fmt.Errorf("ntp: extension fields require version 4, have %d", pkt.Version)
+	}
+	for _, ext := range pkt.Extensions {
+		if extFieldHeaderLength+len(ext.Value) > maxExtFieldLength {
+			return nil, ErrBadExtension
+		}
+	}
+	if pkt.Auth != nil && !isMACTrailerLength(4+len(pkt.Auth.Digest)) {
+		return nil, fmt.Errorf("ntp: invalid MAC length %d", 4+len(pkt.Auth.Digest))
+	}
+	buf = appendExtensions(buf, pkt.Extensions, pkt.Auth != nil)
+	return appendMAC(buf, pkt.Auth), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It returns a
+// *PacketLengthError, *PacketVersionError or *PacketModeError for packets
+// that cannot be NTP, and ErrBadExtension for a malformed trailer.
+func (pkt *NTPv4Packet) UnmarshalBinary(buf []byte) error {
+	if len(buf) < ntpHeaderLength {
+		return &PacketLengthError{Length: len(buf)}
+	}
+	//假设初始值0x23 二进制00100011：0-1位LI=00 2-4位VN=100 5-7位Mode=011
+	version := (buf[0] >> 3) & 0b111
+	mode := buf[0] & 0b111
+	if err := validateVersionMode(version, mode); err != nil {
+		return err
+	}
+	if len(buf)%4 != 0 {
+		return &PacketLengthError{Length: len(buf)}
+	}
+	exts, mac, err := parseTrailer(version, buf[ntpHeaderLength:])
+	if err != nil {
+		return err
+	}
+	*pkt = NTPv4Packet{
+		LeapIndicator:     buf[0] >> 6,
+		Version:           version,
+		Mode:              mode,
+		Stratum:           buf[1],
+		PollInterval:      int8(buf[2]),
+		Precision:         int8(buf[3]),
+		RootDelay:         binary.BigEndian.Uint32(buf[4:8]),
+		RootDisp:          binary.BigEndian.Uint32(buf[8:12]),
+		ReferenceID:       binary.BigEndian.Uint32(buf[12:16]),
+		RefTimestamp:      NtpTimestamp(binary.BigEndian.Uint64(buf[16:24])),
+		OrigTimestamp:     NtpTimestamp(binary.BigEndian.Uint64(buf[24:32])),
+		RecvTimestamp:     NtpTimestamp(binary.BigEndian.Uint64(buf[32:40])),
+		TransmitTimestamp: NtpTimestamp(binary.BigEndian.Uint64(buf[40:48])),
+		Extensions:        exts,
+		Auth:              mac,
+	}
+	return nil
+}
+
+// PacketBuilder constructs NTP packets field by field:
+//
+//	resp, err := NewPacketBuilder().Mode(ModeServer).Stratum(2).Transmit(now).Bytes()
+type PacketBuilder struct {
+	pkt NTPv4Packet
+}
+
+// NewPacketBuilder returns a builder for an NTPv4 packet with every other
+// field zero.
+func NewPacketBuilder() *PacketBuilder {
+	return &PacketBuilder{pkt: NTPv4Packet{Version: 4}}
+}
+
+// Leap sets the leap indicator.
+func (b *PacketBuilder) Leap(li uint8) *PacketBuilder {
+	b.pkt.LeapIndicator = li
+	return b
+}
+
+// Version sets the version number.
+func (b *PacketBuilder) Version(v uint8) *PacketBuilder {
+	b.pkt.Version = v
+	return b
+}
+
+// Mode sets the association mode.
+func (b *PacketBuilder) Mode(mode uint8) *PacketBuilder {
+	b.pkt.Mode = mode
+	return b
+}
+
+// Stratum sets the stratum.
+func (b *PacketBuilder) Stratum(stratum uint8) *PacketBuilder {
+	b.pkt.Stratum = stratum
+	return b
+}
+
+// Poll sets the poll exponent (log2 seconds).
+func (b *PacketBuilder) Poll(poll int8) *PacketBuilder {
+	b.pkt.PollInterval = poll
+	return b
+}
+
+// Precision sets the precision exponent (log2 seconds).
+func (b *PacketBuilder) Precision(precision int8) *PacketBuilder {
+	b.pkt.Precision = precision
+	return b
+}
+
+// RootDelay sets the root delay.
+func (b *PacketBuilder) RootDelay(d time.Duration) *PacketBuilder {
+	b.pkt.RootDelay = DurationToNtpShort(d)
+	return b
+}
+
+// RootDispersion sets the root dispersion.
+func (b *PacketBuilder) RootDispersion(d time.Duration) *PacketBuilder {
+	b.pkt.RootDisp = DurationToNtpShort(d)
+	return b
+}
+
+// ReferenceID sets the raw reference identifier.
+func (b *PacketBuilder) ReferenceID(id uint32) *PacketBuilder {
+	b.pkt.ReferenceID = id
+	return b
+}
+
+// ReferenceIP sets the reference identifier to an upstream server address,
+// as used for stratum 2 and above.
+func (b *PacketBuilder) ReferenceIP(ip net.IP) *PacketBuilder {
+	b.pkt.ReferenceID = refIDFromIP(ip)
+	return b
+}
+
+// ReferenceCode sets the reference identifier to a left-justified ASCII
+// code of up to four characters, as used for stratum 0 and 1.
+func (b *PacketBuilder) ReferenceCode(code string) *PacketBuilder {
+	b.pkt.ReferenceID = refIDFromCode(code)
+	return b
+}
+
+// refIDFromIP returns the reference identifier of a server: its IPv4
+// address, or the first four octets of the MD5 hash of its IPv6 address
+// (RFC 5905 7.3).
+func refIDFromIP(ip net.IP) uint32 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.Uint32(ip4)
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		sum := md5.Sum(ip16)
+		return binary.BigEndian.Uint32(sum[:4])
+	}
+	return 0
+}
+
+// refIDFromCode returns the reference identifier for an ASCII code.
+func refIDFromCode(code string) uint32 {
+	var id [4]byte
+	copy(id[:], code)
+	return binary.BigEndian.Uint32(id[:])
+}
+
+// Reference sets the reference timestamp.
+func (b *PacketBuilder) Reference(ts NtpTimestamp) *PacketBuilder {
+	b.pkt.RefTimestamp = ts
+	return b
+}
+
+// Origin sets the origin timestamp.
+func (b *PacketBuilder) Origin(ts NtpTimestamp) *PacketBuilder {
+	b.pkt.OrigTimestamp = ts
+	return b
+}
+
+// Receive sets the receive timestamp.
+func (b *PacketBuilder) Receive(ts NtpTimestamp) *PacketBuilder {
+	b.pkt.RecvTimestamp = ts
+	return b
+}
+
+// Transmit sets the transmit timestamp.
+func (b *PacketBuilder) Transmit(ts NtpTimestamp) *PacketBuilder {
+	b.pkt.TransmitTimestamp = ts
+	return b
+}
+
+// AddExtension appends an extension field; the value is padded on encoding.
+func (b *PacketBuilder) AddExtension(typ uint16, value []byte) *PacketBuilder {
+	b.pkt.Extensions = append(b.pkt.Extensions, ExtensionField{Type: typ, Value: value})
+	return b
+}
+
+// MAC sets the Key ID / Message Digest trailer.
+func (b *PacketBuilder) MAC(keyID uint32, digest []byte) *PacketBuilder {
+	b.pkt.Auth = &MACTrailer{KeyID: keyID, Digest: digest}
+	return b
+}
+
+// Packet returns a copy of the packet built so far.
+func (b *PacketBuilder) Packet() NTPv4Packet {
+	return b.pkt
+}
+
+// Bytes encodes the packet built so far.
+func (b *PacketBuilder) Bytes() ([]byte, error) {
+	return b.pkt.MarshalBinary()
+}
+
+// KissCode returns the ASCII kiss code of a kiss-o'-death packet, such as
+// "RATE", without the dots ReferenceIDString adds.
+func (pkt *NTPv4Packet) KissCode() string {
+	return strings.Trim(ReferenceIDString(0, pkt.ReferenceID), ".")
+}
+
+// ReferenceIDString formats a reference identifier the way ntpq does: an
+// ASCII code for stratum 0 and 1, a dotted IPv4 address otherwise.
+func ReferenceIDString(stratum uint8, id uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], id)
+	if stratum <= 1 {
+		n := 0
+		for n < 4 && b[n] != 0 {
+			n++
+		}
+		return "." + string(b[:n]) + "."
+	}
+	return net.IP(b[:]).String()
+}
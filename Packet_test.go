@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	now := NewNtpTimestamp(time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.UTC))
+	header := func(version uint8) NTPv4Packet {
+		return NTPv4Packet{
+			LeapIndicator:     LeapAddSecond,
+			Version:           version,
+			Mode:              ModeServer,
+			Stratum:           2,
+			PollInterval:      6,
+			Precision:         -20,
+			RootDelay:         DurationToNtpShort(3 * time.Millisecond),
+			RootDisp:          DurationToNtpShort(7 * time.Millisecond),
+			ReferenceID:       0x0a0a0a0a,
+			RefTimestamp:      now - 1<<32,
+			OrigTimestamp:     now - 1,
+			RecvTimestamp:     now,
+			TransmitTimestamp: now + 1,
+		}
+	}
+	digest16 := bytes.Repeat([]byte{0xab}, 16)
+	digest20 := bytes.Repeat([]byte{0xcd}, 20)
+	tests := []struct {
+		name   string
+		pkt    func() NTPv4Packet
+		length int
+	}{
+		{"v3", func() NTPv4Packet { return header(3) }, 48},
+		{"v3 MD5", func() NTPv4Packet {
+			p := header(3)
+			p.Auth = &MACTrailer{KeyID: 1, Digest: digest16}
+			return p
+		}, 68},
+		{"v3 SHA1", func() NTPv4Packet {
+			p := header(3)
+			p.Auth = &MACTrailer{KeyID: 2, Digest: digest20}
+			return p
+		}, 72},
+		{"v4 crypto-NAK", func() NTPv4Packet {
+			p := header(4)
+			p.Auth = &MACTrailer{}
+			return p
+		}, 52},
+		{"v4 EF only", func() NTPv4Packet {
+			p := header(4)
+			p.Extensions = []ExtensionField{{Type: ExtNtsUniqueIdentifier, Value: bytes.Repeat([]byte{1}, 32)}}
+			return p
+		}, 84},
+		{"v4 EF+MAC", func() NTPv4Packet {
+			p := header(4)
+			p.Extensions = []ExtensionField{
+				{Type: ExtNtsUniqueIdentifier, Value: bytes.Repeat([]byte{1}, 12)},
+				{Type: ExtNtsCookie, Value: bytes.Repeat([]byte{2}, 100)},
+			}
+			p.Auth = &MACTrailer{KeyID: 7, Digest: digest20}
+			return p
+		}, 48 + 16 + 104 + 24},
+	}
+	for _, tt := range tests {
+		want := tt.pkt()
+		buf, err := want.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: MarshalBinary: %v", tt.name, err)
+			continue
+		}
+		if len(buf) != tt.length {
+			t.Errorf("%s: encoded %d bytes, want %d", tt.name, len(buf), tt.length)
+		}
+		var got NTPv4Packet
+		if err := got.UnmarshalBinary(buf); err != nil {
+			t.Errorf("%s: UnmarshalBinary: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: round trip\n got %+v\nwant %+v", tt.name, got, want)
+		}
+	}
+}
+
+// TestPacketMarshalPadding checks the documented exception to the round
+// trip: short or unaligned extension values come back padded.
+func TestPacketMarshalPadding(t *testing.T) {
+	buf, err := NewPacketBuilder().Mode(ModeClient).AddExtension(ExtNtsCookie, []byte{1, 2, 3, 4, 5}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 48+minLastExtNoMAC {
+		t.Fatalf("encoded %d bytes, want %d", len(buf), 48+minLastExtNoMAC)
+	}
+	var pkt NTPv4Packet
+	if err := pkt.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, minLastExtNoMAC-extFieldHeaderLength)
+	copy(want, []byte{1, 2, 3, 4, 5})
+	if !bytes.Equal(pkt.Extensions[0].Value, want) {
+		t.Errorf("value %x, want %x", pkt.Extensions[0].Value, want)
+	}
+}
+
+func TestPacketMarshalErrors(t *testing.T) {
+	var verr *PacketVersionError
+	if _, err := NewPacketBuilder().Version(5).Mode(ModeClient).Bytes(); !errors.As(err, &verr) {
+		t.Errorf("version 5: got %v, want *PacketVersionError", err)
+	}
+	var merr *PacketModeError
+	if _, err := NewPacketBuilder().Mode(ModeReserved).Bytes(); !errors.As(err, &merr) {
+		t.Errorf("v4 mode 0: got %v, want *PacketModeError", err)
+	}
+	if _, err := NewPacketBuilder().Mode(ModeClient).MAC(1, make([]byte, 12)).Bytes(); err == nil {
+		t.Error("12-byte digest encoded without error")
+	}
+	if _, err := NewPacketBuilder().Mode(ModeClient).AddExtension(ExtNtsCookie, make([]byte, 0x10000)).Bytes(); !errors.Is(err, ErrBadExtension) {
+		t.Errorf("oversized extension: got %v, want ErrBadExtension", err)
+	}
+	var lerr *PacketLengthError
+	var pkt NTPv4Packet
+	if err := pkt.UnmarshalBinary(make([]byte, 47)); !errors.As(err, &lerr) {
+		t.Errorf("47 bytes: got %v, want *PacketLengthError", err)
+	}
+}
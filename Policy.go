@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kiss codes carried in the Reference ID of a kiss-o'-death packet (RFC 5905 7.4)
+const (
+	KissRate     = "RATE" //请求过于频繁，客户端应降低轮询频率
+	KissDeny     = "DENY" //拒绝服务，客户端应停止向本服务器发送请求
+	KissRestrict = "RSTR" //访问受限，客户端应停止向本服务器发送请求
+	KissNtsNak   = "NTSN" //NTS cookie无效，客户端需重新进行NTS-KE
+)
+
+// PolicyDecision is what the request pipeline does with a packet.
+type PolicyDecision int
+
+const (
+	PolicyServe        PolicyDecision = iota //正常应答
+	PolicyDrop                               //静默丢弃
+	PolicyKissRate                           //回复KoD RATE
+	PolicyKissDeny                           //回复KoD DENY
+	PolicyKissRestrict                       //回复KoD RSTR
+)
+
+// KissCode returns the kiss code for KoD decisions and "" otherwise.
+func (d PolicyDecision) KissCode() string {
+	switch d {
+	case PolicyKissRate:
+		return KissRate
+	case PolicyKissDeny:
+		return KissDeny
+	case PolicyKissRestrict:
+		return KissRestrict
+	}
+	return ""
+}
+
+const maxRateClients = 65536 //限速表最大客户端数量
+
+// AccessPolicy decides per source address whether a request is served,
+// dropped or answered with a kiss-o'-death packet.
+type AccessPolicy struct {
+	Ignore   []*net.IPNet //静默丢弃
+	Deny     []*net.IPNet //回复DENY
+	Restrict []*net.IPNet //回复RSTR
+
+	// MinInterval is the average spacing allowed between requests from one
+	// address; Burst requests may arrive back to back. Zero disables rate
+	// limiting.
+	MinInterval time.Duration
+	Burst       int
+
+	mu      sync.Mutex
+	clients map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens   float64
+	last     time.Time
+	lastKiss time.Time
+}
+
+// ParseNetList parses a comma separated list of CIDRs or bare addresses.
+func ParseNetList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide returns the decision for a request from ip received at now.
+// A nil policy serves everything.
+func (p *AccessPolicy) Decide(ip net.IP, now time.Time) PolicyDecision {
+	if p == nil {
+		return PolicyServe
+	}
+	switch {
+	case containsIP(p.Ignore, ip):
+		return PolicyDrop
+	case containsIP(p.Deny, ip):
+		return PolicyKissDeny
+	case containsIP(p.Restrict, ip):
+		return PolicyKissRestrict
+	}
+	if p.MinInterval <= 0 {
+		return PolicyServe
+	}
+	return p.rateLimit(ip, now)
+}
+
+// rateLimit runs a token bucket per address. A client over its limit gets
+// at most one RATE kiss per MinInterval; further excess is dropped so the
+// server cannot be used to flood a spoofed address with KoD packets.
+func (p *AccessPolicy) rateLimit(ip net.IP, now time.Time) PolicyDecision {
+	burst := float64(p.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients == nil {
+		p.clients = make(map[string]*rateBucket)
+	}
+	key := ip.String()
+	b, ok := p.clients[key]
+	if !ok {
+		if len(p.clients) >= maxRateClients {
+			p.expire(now)
+		}
+		b = &rateBucket{tokens: burst, last: now}
+		p.clients[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(p.MinInterval)
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return PolicyServe
+	}
+	if now.Sub(b.lastKiss) < p.MinInterval {
+		return PolicyDrop
+	}
+	b.lastKiss = now
+	return PolicyKissRate
+}
+
+// expire removes idle clients; if every entry is active the table is reset.
+func (p *AccessPolicy) expire(now time.Time) {
+	idle := p.MinInterval * time.Duration(p.Burst+1) * 8
+	for k, b := range p.clients {
+		if now.Sub(b.last) > idle {
+			delete(p.clients, k)
+		}
+	}
+	if len(p.clients) >= maxRateClients {
+		p.clients = make(map[string]*rateBucket)
+	}
+}
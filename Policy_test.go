@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPolicyRateLimit(t *testing.T) {
+	p := &AccessPolicy{MinInterval: time.Second, Burst: 2}
+	client, other := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		ip    net.IP
+		after time.Duration
+		want  PolicyDecision
+	}{
+		{"first of burst", client, 0, PolicyServe},
+		{"second of burst", client, 0, PolicyServe},
+		{"burst exceeded", client, 0, PolicyKissRate},
+		{"other client unaffected", other, 0, PolicyServe},
+		{"again within MinInterval of the kiss", client, 100 * time.Millisecond, PolicyDrop},
+		{"one token refilled", client, time.Second, PolicyServe},
+		{"over again after MinInterval", client, 1500 * time.Millisecond, PolicyKissRate},
+		{"refilled again", client, 2 * time.Second, PolicyServe},
+		{"idle refills only up to the burst", client, time.Minute, PolicyServe},
+		{"idle second", client, time.Minute, PolicyServe},
+		{"idle third", client, time.Minute, PolicyKissRate},
+	}
+	for _, tt := range tests {
+		if got := p.Decide(tt.ip, t0.Add(tt.after)); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyPrecedence(t *testing.T) {
+	nets := func(list string) []*net.IPNet {
+		n, err := ParseNetList(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	p := &AccessPolicy{
+		Ignore:      nets("192.0.2.1"),
+		Deny:        nets("192.0.2.0/30"),
+		Restrict:    nets("192.0.2.0/24"),
+		MinInterval: time.Hour,
+	}
+	now := time.Now()
+	tests := []struct {
+		ip   net.IP
+		want PolicyDecision
+	}{
+		{net.IPv4(192, 0, 2, 1), PolicyDrop},           //三个列表都包含
+		{net.IPv4(192, 0, 2, 2), PolicyKissDeny},       //Deny和Restrict
+		{net.IPv4(192, 0, 2, 100), PolicyKissRestrict}, //只在Restrict中
+		{net.IPv4(198, 51, 100, 1), PolicyServe},
+	}
+	// 第二轮：列表中的地址不经过限速，不在列表中的地址被限速
+	for round := 0; round < 2; round++ {
+		for _, tt := range tests {
+			want := tt.want
+			if round == 1 && want == PolicyServe {
+				want = PolicyKissRate
+			}
+			if got := p.Decide(tt.ip, now); got != want {
+				t.Errorf("round %d %v: %v, want %v", round, tt.ip, got, want)
+			}
+		}
+	}
+
+	var nilPolicy *AccessPolicy
+	if got := nilPolicy.Decide(net.IPv4(192, 0, 2, 1), now); got != PolicyServe {
+		t.Errorf("nil policy: %v, want serve", got)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const maxTraceHops = 16 //ntptrace最多追踪的层数
+
+// probeResult is one row of probe output.
+type probeResult struct {
+	Server       string  `json:"server"`
+	Address      string  `json:"address,omitempty"`
+	Stratum      uint8   `json:"stratum,omitempty"`
+	RefID        string  `json:"refid,omitempty"`
+	Leap         string  `json:"leap,omitempty"`
+	Offset       float64 `json:"offset"`        //秒
+	Delay        float64 `json:"delay"`         //秒
+	RootDistance float64 `json:"root_distance"` //秒
+	Samples      int     `json:"samples"`       //成功的样本数
+	Error        string  `json:"error,omitempty"`
+
+	sample Sample
+}
+
+var leapNames = [4]string{"none", "insert", "delete", "unsync"}
+
+// runProbe implements "probe [flags] host...": query each host like ntpdate
+// -q, or with -trace follow the Reference ID chain to stratum 1 like
+// ntptrace. It returns the process exit status: 0 when every host answered
+// within -max-offset, 1 otherwise.
+func runProbe(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("probe", flag.ContinueOnError)
+	samples := fs.Int("n", 4, "samples per server")
+	interval := fs.Duration("interval", 500*time.Millisecond, "pause between samples")
+	timeout := fs.Duration("timeout", 2*time.Second, "timeout per sample")
+	port := fs.Int("port", 123, "NTP port")
+	trace := fs.Bool("trace", false, "follow the reference ID chain up to stratum 1")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	maxOffset := fs.Duration("max-offset", 0, "fail when a server's offset exceeds this, 0 disables the check")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: probe [flags] host...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var results []probeResult
+	for _, host := range fs.Args() {
+		if *trace {
+			results = append(results, probeTrace(host, *port, *samples, *interval, *timeout)...)
+		} else {
+			results = append(results, probeHost(host, *port, *samples, *interval, *timeout))
+		}
+	}
+
+	status := 0
+	for _, r := range results {
+		if r.Error != "" || *maxOffset > 0 && absDuration(r.sample.Offset) > *maxOffset {
+			status = 1
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return status
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "server\taddress\tst\trefid\tleap\toffset(ms)\tdelay(ms)\trootdist(ms)\tsamples\t")
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\t-\t%d\t  %s\n", r.Server, r.Address, r.Samples, r.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%+.3f\t%.3f\t%.3f\t%d\t\n", r.Server, r.Address, r.Stratum, r.RefID, r.Leap,
+			r.Offset*1e3, r.Delay*1e3, r.RootDistance*1e3, r.Samples)
+	}
+	w.Flush()
+	return status
+}
+
+// probeHost takes n samples of host and reports the one with the lowest
+// delay, which carries the least queueing error.
+func probeHost(host string, port, n int, interval, timeout time.Duration) probeResult {
+	r := probeResult{Server: host}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Address = addr.IP.String()
+	var lastErr error
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		s, err := QueryServer(addr, timeout, nil, nil)
+		if err != nil {
+			lastErr = err
+			var kod *KissError
+			if errors.As(err, &kod) {
+				break //收到KoD后不再继续发送
+			}
+			continue
+		}
+		if r.Samples == 0 || s.Delay < r.sample.Delay {
+			r.sample = s
+		}
+		r.Samples++
+	}
+	if r.Samples == 0 {
+		r.Error = lastErr.Error()
+		return r
+	}
+	s := r.sample
+	r.Stratum = s.Stratum
+	r.RefID = ReferenceIDString(s.Stratum, s.RefID)
+	r.Leap = leapNames[s.Leap]
+	r.Offset = s.Offset.Seconds()
+	r.Delay = s.Delay.Seconds()
+	r.RootDistance = rootDistance(s).Seconds()
+	return r
+}
+
+// probeTrace follows the Reference IDs from host towards stratum 1. The
+// trace ends at stratum 1, where the Reference ID is an ASCII code, and
+// wherever the next hop cannot be told from the Reference ID; see
+// traceNextHop.
+func probeTrace(host string, port, n int, interval, timeout time.Duration) []probeResult {
+	var hops []probeResult
+	seen := make(map[string]bool)
+	for len(hops) < maxTraceHops {
+		r := probeHost(host, port, n, interval, timeout)
+		hops = append(hops, r)
+		if seen[r.Address] {
+			break
+		}
+		seen[r.Address] = true
+		next, ok := traceNextHop(r)
+		if !ok {
+			break
+		}
+		host = next.String()
+	}
+	return hops
+}
+
+// traceNextHop returns the upstream named by the Reference ID of r. There
+// is none after a failed probe or at stratum 0, 1 and 16, where the
+// Reference ID is a kiss or ASCII code. A server queried over IPv6 most
+// likely has an IPv6 upstream, whose Reference ID is a hash rather than an
+// address, so the trace stops there too, as it does at Reference IDs that
+// are not routable IPv4 addresses.
+func traceNextHop(r probeResult) (net.IP, bool) {
+	if r.Error != "" || r.Stratum <= 1 || r.Stratum >= 16 {
+		return nil, false
+	}
+	if ip := net.ParseIP(r.Address); ip == nil || ip.To4() == nil {
+		return nil, false
+	}
+	next := net.ParseIP(r.RefID).To4()
+	if next == nil || !routableIPv4(next) {
+		return nil, false
+	}
+	return next, true
+}
+
+// routableIPv4 reports whether ip can be the address of a remote server:
+// not 0/8, loopback, link-local, multicast or the reserved 240/4 block.
+func routableIPv4(ip net.IP) bool {
+	return ip[0] != 0 && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsMulticast() && ip[0] < 240
+}
+
+// rootDistance is the maximum error of a sample relative to the primary
+// reference: half the total round trip plus the accumulated dispersion
+// (RFC 5905 11.2).
+func rootDistance(s Sample) time.Duration {
+	return (s.RootDelay+s.Delay)/2 + s.RootDisp
+}
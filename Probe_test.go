@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTraceNextHop(t *testing.T) {
+	tests := []struct {
+		name string
+		r    probeResult
+		want string //空表示追踪结束
+	}{
+		{"stratum 2 over IPv4", probeResult{Address: "192.0.2.10", Stratum: 2, RefID: "198.51.100.7"}, "198.51.100.7"},
+		{"private upstream", probeResult{Address: "192.0.2.10", Stratum: 3, RefID: "10.1.2.3"}, "10.1.2.3"},
+		{"probe failed", probeResult{Address: "192.0.2.10", Error: "timeout"}, ""},
+		{"stratum 1", probeResult{Address: "192.0.2.10", Stratum: 1, RefID: ".GPS."}, ""},
+		{"kiss code", probeResult{Address: "192.0.2.10", Stratum: 0, RefID: ".RATE."}, ""},
+		{"unsynchronised", probeResult{Address: "192.0.2.10", Stratum: 16, RefID: "73.78.73.84"}, ""},
+		{"queried over IPv6", probeResult{Address: "2001:db8::10", Stratum: 2, RefID: "198.51.100.7"}, ""},
+		{"loopback", probeResult{Address: "192.0.2.10", Stratum: 2, RefID: "127.0.0.1"}, ""},
+		{"zero network", probeResult{Address: "192.0.2.10", Stratum: 2, RefID: "0.12.34.56"}, ""},
+		{"link-local", probeResult{Address: "192.0.2.10", Stratum: 2, RefID: "169.254.1.1"}, ""},
+		{"multicast", probeResult{Address: "192.0.2.10", Stratum: 2, RefID: "224.0.1.1"}, ""},
+		{"reserved", probeResult{Address: "192.0.2.10", Stratum: 2, RefID: "250.17.3.9"}, ""},
+	}
+	for _, tt := range tests {
+		next, ok := traceNextHop(tt.r)
+		got := ""
+		if ok {
+			got = next.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: next hop %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestTraceStopsAtLocalClock traces a server that serves its own clock: the
+// answer must not name a public address for the trace to follow.
+func TestTraceStopsAtLocalClock(t *testing.T) {
+	server := serveNTP(t, &NTPService{})
+	hops := probeTrace(loopback.String(), server.Port, 1, 0, time.Second)
+	if len(hops) != 1 {
+		t.Fatalf("trace %+v, want one hop", hops)
+	}
+	if r := hops[0]; r.Error != "" || r.Stratum != localStratum || r.RefID != localRefIP.String() {
+		t.Errorf("hop %+v, want stratum %d refid %v", r, localStratum, localRefIP)
+	}
+}
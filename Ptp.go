@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// PTPv2 (IEEE 1588-2008) over UDP/IPv4 with software timestamps. The master
+// is two-step: Sync carries an approximate time and Follow_Up the time
+// taken right after Sync left the socket.
+const (
+	PtpEventPort             = 319
+	PtpGeneralPort           = 320
+	DefaultPtpSyncInterval   = time.Second
+	DefaultPtpAnnounceFactor = 2  //Announce间隔为Sync间隔的倍数
+	ptpDefaultUtcOffset      = 37 //没有leapfile时使用的TAI-UTC，此时不设置currentUtcOffsetValid
+	ptpVersion               = 2
+	ptpHeaderSize            = 34
+	ptpTimestampSize         = 10
+	ptpLeapWarning           = 12 * time.Hour //闰秒前多久设置leap61/leap59
+)
+
+var PtpMulticastIPv4 = net.IPv4(224, 0, 1, 129) //PTP primary 组播地址
+
+// PTP message types
+const (
+	ptpSync      = 0x0
+	ptpDelayReq  = 0x1
+	ptpFollowUp  = 0x8
+	ptpDelayResp = 0x9
+	ptpAnnounce  = 0xb
+)
+
+// PTP flagField bits, first byte then second byte.
+const (
+	ptpFlagTwoStep        = 0x0200
+	ptpFlagUnicast        = 0x0400
+	ptpFlagLeap61         = 0x0001
+	ptpFlagLeap59         = 0x0002
+	ptpFlagUtcOffsetValid = 0x0004
+	ptpFlagPtpTimescale   = 0x0008
+	ptpFlagTimeTraceable  = 0x0010
+	ptpFlagFreqTraceable  = 0x0020
+)
+
+// clockClass and timeSource values used in Announce
+const (
+	ptpClassLocked     = 6    //已同步到外部时间源
+	ptpClassHoldover   = 7    //曾同步，现在保持
+	ptpClassDefault    = 248  //自由运行的本地时钟
+	ptpAccuracyUnknown = 0xfe //clockAccuracy 未知
+	ptpSourceNTP       = 0x50
+	ptpSourceOsc       = 0xa0 //INTERNAL_OSCILLATOR
+)
+
+// PTPMaster is a PTP grandmaster that serves the time of an NTPService.
+// Dest is the PTP multicast group or, for testing and unicast slaves, a
+// unicast address; Delay_Resp goes to the group or back to the requester.
+type PTPMaster struct {
+	Service          *NTPService
+	Policy           *AccessPolicy
+	Dest             net.IP         //组播组或单播地址
+	EventPort        int            //发往Dest的事件端口，0表示319
+	GeneralPort      int            //发往Dest的通用端口，0表示320
+	Listen           net.IP         //绑定的本地地址，nil表示所有地址
+	Interface        *net.Interface //组播接口，同时用于生成clockIdentity
+	TTL              int
+	Domain           uint8
+	Priority1        uint8
+	Priority2        uint8
+	SyncInterval     time.Duration //必须是2的整数次幂秒
+	AnnounceInterval time.Duration
+
+	identity    [8]byte
+	event       *net.UDPConn
+	general     *net.UDPConn
+	mu          sync.Mutex //保护general上的写操作和序列号
+	syncSeq     uint16
+	announceSeq uint16
+}
+
+// Run opens the event and general sockets and sends Announce and Sync
+// messages while answering Delay_Req, until stop is closed or a socket
+// fails.
+func (m *PTPMaster) Run(stop <-chan struct{}) error {
+	if m.Dest.To4() == nil {
+		return fmt.Errorf("ptp: %v is not an IPv4 address", m.Dest)
+	}
+	event, err := m.listen(PtpEventPort)
+	if err != nil {
+		return err
+	}
+	defer event.Close()
+	general, err := m.listen(PtpGeneralPort)
+	if err != nil {
+		return err
+	}
+	defer general.Close()
+	return m.Serve(event, general, stop)
+}
+
+// Serve runs the master on already opened event and general sockets until
+// stop is closed or reading the event socket fails. The caller closes the
+// sockets.
+func (m *PTPMaster) Serve(event, general *net.UDPConn, stop <-chan struct{}) error {
+	if m.SyncInterval <= 0 {
+		m.SyncInterval = DefaultPtpSyncInterval
+	}
+	if m.AnnounceInterval <= 0 {
+		m.AnnounceInterval = DefaultPtpAnnounceFactor * m.SyncInterval
+	}
+	m.identity = ptpClockIdentity(m.Interface)
+	m.event, m.general = event, general
+	fmt.Printf("PTP master %x domain %d sending to %v\n", m.identity, m.Domain, m.Dest)
+
+	errc := make(chan error, 1)
+	go func() { errc <- m.serveDelayRequests() }()
+	syncTicker := time.NewTicker(m.SyncInterval)
+	defer syncTicker.Stop()
+	announceTicker := time.NewTicker(m.AnnounceInterval)
+	defer announceTicker.Stop()
+	m.announce()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err := <-errc:
+			return err
+		case <-announceTicker.C:
+			m.announce()
+		case <-syncTicker.C:
+			m.sync()
+		}
+	}
+}
+
+// listen binds one of the PTP ports and joins Dest when it is a group.
+func (m *PTPMaster) listen(port int) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: m.Listen, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	if m.Dest.IsMulticast() {
+		ttl := m.TTL
+		if ttl <= 0 {
+			ttl = DefaultMulticastTTL
+		}
+		if err := setMulticastOptions(conn, false, ttl, m.Interface); err != nil {
+			fmt.Println("WARNING: cannot set PTP multicast TTL/interface:", err)
+		}
+		if err := joinMulticastGroup(conn, m.Dest, m.Interface); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (m *PTPMaster) eventAddr() *net.UDPAddr {
+	port := m.EventPort
+	if port == 0 {
+		port = PtpEventPort
+	}
+	return &net.UDPAddr{IP: m.Dest, Port: port}
+}
+
+func (m *PTPMaster) generalAddr(ip net.IP) *net.UDPAddr {
+	port := m.GeneralPort
+	if port == 0 {
+		port = PtpGeneralPort
+	}
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+// sync sends a two-step Sync and its Follow_Up.
+func (m *PTPMaster) sync() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seq := m.syncSeq
+	m.syncSeq++
+	now, offset, flags := m.timescale()
+	msg := m.header(ptpSync, 44, flags|ptpFlagTwoStep, seq, 0, m.logInterval(m.SyncInterval))
+	putPtpTimestamp(msg[ptpHeaderSize:], now, offset)
+	if _, err := m.event.WriteToUDP(msg, m.eventAddr()); err != nil {
+		fmt.Println("Error sending PTP Sync:", err)
+		return
+	}
+	sent := m.Service.Now() //软件时间戳：Sync离开套接字后立即取时间
+
+	msg = m.header(ptpFollowUp, 44, flags, seq, 2, m.logInterval(m.SyncInterval))
+	putPtpTimestamp(msg[ptpHeaderSize:], sent, offset)
+	if _, err := m.general.WriteToUDP(msg, m.generalAddr(m.Dest)); err != nil {
+		fmt.Println("Error sending PTP Follow_Up:", err)
+	}
+}
+
+// announce advertises this clock for the best master clock algorithm.
+func (m *PTPMaster) announce() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seq := m.announceSeq
+	m.announceSeq++
+	now, offset, flags := m.timescale()
+	class, source := uint8(ptpClassDefault), uint8(ptpSourceOsc)
+	if m.Service.Sync != nil {
+		source = ptpSourceNTP
+		class = ptpClassHoldover
+		if m.Service.Sync.Synchronized(now) {
+			class = ptpClassLocked
+			flags |= ptpFlagTimeTraceable | ptpFlagFreqTraceable
+		}
+	}
+	msg := m.header(ptpAnnounce, 64, flags, seq, 5, m.logInterval(m.AnnounceInterval))
+	b := msg[ptpHeaderSize:]
+	putPtpTimestamp(b, now, offset)
+	binary.BigEndian.PutUint16(b[10:], uint16(offset)) //currentUtcOffset
+	b[13] = m.Priority1
+	b[14] = class
+	b[15] = ptpAccuracyUnknown
+	binary.BigEndian.PutUint16(b[16:], 0xffff) //offsetScaledLogVariance
+	b[18] = m.Priority2
+	copy(b[19:27], m.identity[:])         //grandmasterIdentity
+	binary.BigEndian.PutUint16(b[27:], 0) //stepsRemoved
+	b[29] = source
+	if _, err := m.general.WriteToUDP(msg, m.generalAddr(m.Dest)); err != nil {
+		fmt.Println("Error sending PTP Announce:", err)
+	}
+}
+
+// serveDelayRequests answers Delay_Req on the event port with the time it
+// was received.
+func (m *PTPMaster) serveDelayRequests() error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := m.event.ReadFromUDP(buf)
+		recvTime := m.Service.Now()
+		if err != nil {
+			return err
+		}
+		req := buf[:n]
+		if n < ptpHeaderSize+ptpTimestampSize || req[0]&0x0f != ptpDelayReq || req[1]&0x0f != ptpVersion || req[4] != m.Domain {
+			continue
+		}
+		if m.Policy.Decide(addr.IP, recvTime) != PolicyServe {
+			continue
+		}
+		m.delayResponse(req, addr, recvTime)
+	}
+}
+
+func (m *PTPMaster) delayResponse(req []byte, addr *net.UDPAddr, recvTime time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, offset, flags := m.timescale()
+	dest := m.generalAddr(m.Dest)
+	if !m.Dest.IsMulticast() {
+		dest = m.generalAddr(addr.IP) //单播：发回请求方的general端口
+	}
+	seq := binary.BigEndian.Uint16(req[30:32])
+	msg := m.header(ptpDelayResp, 54, flags, seq, 3, m.logInterval(m.SyncInterval))
+	copy(msg[8:16], req[8:16]) //correctionField 与请求相同
+	putPtpTimestamp(msg[ptpHeaderSize:], recvTime, offset)
+	copy(msg[ptpHeaderSize+ptpTimestampSize:], req[20:30]) //requestingPortIdentity
+	if _, err := m.general.WriteToUDP(msg, dest); err != nil {
+		fmt.Println("Error sending PTP Delay_Resp:", err)
+	}
+}
+
+// timescale returns the served time, TAI-UTC and the matching flags. PTP
+// counts TAI seconds, so every timestamp is the served UTC time plus the
+// offset.
+func (m *PTPMaster) timescale() (time.Time, int, uint16) {
+	now := m.Service.Now()
+	flags := uint16(ptpFlagPtpTimescale)
+	offset := ptpDefaultUtcOffset
+	if m.Service.Leap != nil {
+		offset = m.Service.Leap.TAIOffset(now)
+		flags |= ptpFlagUtcOffsetValid
+		// 平滑模式下闰秒对下游不可见
+		if next, delta, ok := m.Service.Leap.NextLeap(now); ok && m.Service.Smear == nil && next.At.Sub(now) <= ptpLeapWarning {
+			if delta > 0 {
+				flags |= ptpFlagLeap61
+			} else {
+				flags |= ptpFlagLeap59
+			}
+		}
+	}
+	return now, offset, flags
+}
+
+// header builds a message of length bytes with the common header filled in.
+func (m *PTPMaster) header(typ uint8, length int, flags, seq uint16, control uint8, logInterval int8) []byte {
+	msg := make([]byte, length)
+	msg[0] = typ
+	msg[1] = ptpVersion
+	binary.BigEndian.PutUint16(msg[2:], uint16(length))
+	msg[4] = m.Domain
+	if !m.Dest.IsMulticast() {
+		flags |= ptpFlagUnicast
+	}
+	binary.BigEndian.PutUint16(msg[6:], flags)
+	copy(msg[20:28], m.identity[:])
+	binary.BigEndian.PutUint16(msg[28:], 1) //portNumber
+	binary.BigEndian.PutUint16(msg[30:], seq)
+	msg[32] = control
+	msg[33] = byte(logInterval)
+	return msg
+}
+
+// logInterval is the interval as a power of two seconds.
+func (m *PTPMaster) logInterval(d time.Duration) int8 {
+	return int8(math.Round(math.Log2(d.Seconds())))
+}
+
+// putPtpTimestamp writes t as a PTP timestamp: 48-bit TAI seconds and
+// nanoseconds.
+func putPtpTimestamp(b []byte, t time.Time, utcOffset int) {
+	secs := uint64(t.Unix() + int64(utcOffset))
+	binary.BigEndian.PutUint16(b[0:], uint16(secs>>32))
+	binary.BigEndian.PutUint32(b[2:], uint32(secs))
+	binary.BigEndian.PutUint32(b[6:], uint32(t.Nanosecond()))
+}
+
+// ptpClockIdentity derives the EUI-64 clockIdentity from the interface MAC
+// address, or makes a random one when there is none.
+func ptpClockIdentity(ifi *net.Interface) [8]byte {
+	var id [8]byte
+	if ifi != nil && len(ifi.HardwareAddr) == 6 {
+		mac := ifi.HardwareAddr
+		copy(id[:3], mac[:3])
+		id[3], id[4] = 0xff, 0xfe
+		copy(id[5:], mac[3:])
+		return id
+	}
+	rand.Read(id[:])
+	id[0] |= 0x02 //本地管理的地址
+	return id
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// ptpTime decodes a PTP timestamp taken with the default TAI-UTC offset.
+func ptpTime(b []byte) time.Time {
+	secs := uint64(binary.BigEndian.Uint16(b[0:]))<<32 | uint64(binary.BigEndian.Uint32(b[2:]))
+	return time.Unix(int64(secs)-ptpDefaultUtcOffset, int64(binary.BigEndian.Uint32(b[6:])))
+}
+
+// readPtp returns the next message of type typ on conn, skipping others.
+func readPtp(t *testing.T, conn *net.UDPConn, typ uint8) []byte {
+	t.Helper()
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("waiting for PTP message %#x: %v", typ, err)
+		}
+		if n >= ptpHeaderSize && buf[0]&0x0f == typ {
+			return append([]byte(nil), buf[:n]...)
+		}
+	}
+}
+
+func checkRecent(t *testing.T, what string, ts time.Time) {
+	t.Helper()
+	if d := time.Since(ts); d < -time.Millisecond || d > time.Second {
+		t.Errorf("%s timestamp %v is %v old", what, ts, d)
+	}
+}
+
+// TestPtpLoopback runs a unicast master on 127.0.0.1 with ephemeral ports
+// and checks Announce, the two-step Sync/Follow_Up pair and a
+// Delay_Req/Delay_Resp exchange.
+func TestPtpLoopback(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		return conn
+	}
+	event, general := listen(), listen()
+	slaveEvent, slaveGeneral := listen(), listen()
+	const domain = 4
+	m := &PTPMaster{
+		Service:      &NTPService{},
+		Dest:         loopback,
+		EventPort:    slaveEvent.LocalAddr().(*net.UDPAddr).Port,
+		GeneralPort:  slaveGeneral.LocalAddr().(*net.UDPAddr).Port,
+		Domain:       domain,
+		SyncInterval: time.Second / 8,
+	}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- m.Serve(event, general, stop) }()
+
+	header := func(msg []byte, typ uint8) {
+		t.Helper()
+		if msg[1]&0x0f != ptpVersion || msg[4] != domain {
+			t.Errorf("message %#x: version %d domain %d", typ, msg[1]&0x0f, msg[4])
+		}
+		if flags := binary.BigEndian.Uint16(msg[6:]); flags&ptpFlagUnicast == 0 || flags&ptpFlagPtpTimescale == 0 {
+			t.Errorf("message %#x: flags %#04x, want unicast and PTP timescale", typ, flags)
+		}
+	}
+
+	announce := readPtp(t, slaveGeneral, ptpAnnounce)
+	header(announce, ptpAnnounce)
+	b := announce[ptpHeaderSize:]
+	if binary.BigEndian.Uint16(b[10:]) != ptpDefaultUtcOffset || b[14] != ptpClassDefault || b[29] != ptpSourceOsc {
+		t.Errorf("announce utcOffset %d class %d source %#x", binary.BigEndian.Uint16(b[10:]), b[14], b[29])
+	}
+	if !bytes.Equal(b[19:27], announce[20:28]) {
+		t.Error("grandmasterIdentity differs from the sending clockIdentity")
+	}
+
+	sync := readPtp(t, slaveEvent, ptpSync)
+	header(sync, ptpSync)
+	if binary.BigEndian.Uint16(sync[6:])&ptpFlagTwoStep == 0 {
+		t.Error("Sync without the two-step flag")
+	}
+	if int8(sync[33]) != -3 {
+		t.Errorf("logSyncInterval %d, want -3", int8(sync[33]))
+	}
+	var followUp []byte
+	for followUp == nil || !bytes.Equal(followUp[30:32], sync[30:32]) {
+		followUp = readPtp(t, slaveGeneral, ptpFollowUp)
+	}
+	header(followUp, ptpFollowUp)
+	approx, precise := ptpTime(sync[ptpHeaderSize:]), ptpTime(followUp[ptpHeaderSize:])
+	checkRecent(t, "Follow_Up", precise)
+	if precise.Before(approx) {
+		t.Errorf("Follow_Up %v before Sync %v", precise, approx)
+	}
+
+	req := make([]byte, ptpHeaderSize+ptpTimestampSize)
+	req[0] = ptpDelayReq
+	req[1] = ptpVersion
+	binary.BigEndian.PutUint16(req[2:], uint16(len(req)))
+	req[4] = domain
+	copy(req[20:30], []byte{0x02, 1, 2, 3, 4, 5, 6, 7, 0, 1}) //sourcePortIdentity
+	binary.BigEndian.PutUint16(req[30:], 77)
+	if _, err := slaveEvent.WriteToUDP(req, event.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	resp := readPtp(t, slaveGeneral, ptpDelayResp)
+	header(resp, ptpDelayResp)
+	if binary.BigEndian.Uint16(resp[30:]) != 77 || !bytes.Equal(resp[ptpHeaderSize+ptpTimestampSize:], req[20:30]) {
+		t.Errorf("Delay_Resp seq %d port %x, want 77 %x", binary.BigEndian.Uint16(resp[30:]),
+			resp[ptpHeaderSize+ptpTimestampSize:], req[20:30])
+	}
+	checkRecent(t, "Delay_Resp", ptpTime(resp[ptpHeaderSize:]))
+
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Serve:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Serve did not return after stop")
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Roughtime as deployed by Google and Cloudflare ("Google Roughtime"): a
+// client sends a 64 byte nonce, the server answers with a midpoint and
+// radius signed by an online key that the long-term key has delegated to.
+// Requests arriving together are answered from one Merkle tree, so one
+// signature covers the whole batch.
+const (
+	RoughtimePort           = 2002
+	DefaultRoughtimeRotate  = 24 * time.Hour       //在线密钥的更换周期
+	DefaultRoughtimeBatch   = 64                   //一次签名最多覆盖的请求数
+	DefaultRoughtimeWait    = 5 * time.Millisecond //收集同一批请求的最长等待时间
+	roughtimeMinRequestSize = 1024                 //请求最小长度，防止放大攻击
+	roughtimeNonceSize      = 64
+	roughtimeMinRadius      = 10 * time.Millisecond //RADI下限
+	roughtimeDeleContext    = "RoughTime v1 delegation signature--\x00"
+	roughtimeRespContext    = "RoughTime v1 response signature\x00"
+	roughtimeLeafPrefix     = 0x00
+	roughtimeNodePrefix     = 0x01
+)
+
+// Roughtime tags are four ASCII bytes read as a little-endian uint32.
+const (
+	tagSIG  uint32 = 'S' | 'I'<<8 | 'G'<<16
+	tagNONC uint32 = 'N' | 'O'<<8 | 'N'<<16 | 'C'<<24
+	tagDELE uint32 = 'D' | 'E'<<8 | 'L'<<16 | 'E'<<24
+	tagPATH uint32 = 'P' | 'A'<<8 | 'T'<<16 | 'H'<<24
+	tagRADI uint32 = 'R' | 'A'<<8 | 'D'<<16 | 'I'<<24
+	tagPUBK uint32 = 'P' | 'U'<<8 | 'B'<<16 | 'K'<<24
+	tagMIDP uint32 = 'M' | 'I'<<8 | 'D'<<16 | 'P'<<24
+	tagSREP uint32 = 'S' | 'R'<<8 | 'E'<<16 | 'P'<<24
+	tagMINT uint32 = 'M' | 'I'<<8 | 'N'<<16 | 'T'<<24
+	tagROOT uint32 = 'R' | 'O'<<8 | 'O'<<16 | 'T'<<24
+	tagCERT uint32 = 'C' | 'E'<<8 | 'R'<<16 | 'T'<<24
+	tagMAXT uint32 = 'M' | 'A'<<8 | 'X'<<16 | 'T'<<24
+	tagINDX uint32 = 'I' | 'N'<<8 | 'D'<<16 | 'X'<<24
+)
+
+var ErrRoughtimeMessage = errors.New("malformed roughtime message")
+
+// RoughtimeServer answers Roughtime requests from the same clock and access
+// policy as NTP. Like manycast it stays silent while unsynchronised, since
+// a signed wrong time is worse than no answer.
+type RoughtimeServer struct {
+	Service *NTPService
+	Policy  *AccessPolicy
+	Addr    string             //监听地址 默认 ":2002"
+	Key     ed25519.PrivateKey //长期密钥，只用于签发在线密钥
+	Rotate  time.Duration      //在线密钥更换周期
+	Batch   int                //一批最多请求数
+	Wait    time.Duration      //收集一批请求的等待时间
+
+	online *roughtimeOnlineKey
+}
+
+type roughtimeOnlineKey struct {
+	key     ed25519.PrivateKey
+	cert    []byte    //CERT：长期密钥对DELE的签名
+	renewAt time.Time //到期前更换
+}
+
+type roughtimeRequest struct {
+	addr  net.Addr
+	nonce []byte
+}
+
+// LoadRoughtimeKey reads a long-term key file: the 32 byte Ed25519 seed in
+// hex on the first line that is not a comment.
+func LoadRoughtimeKey(path string) (ed25519.PrivateKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seed, err := hex.DecodeString(line)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s: expected a %d byte hex seed", path, ed25519.SeedSize)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s: no key found", path)
+}
+
+// ListenAndServe serves Roughtime on UDP until the socket fails.
+func (s *RoughtimeServer) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", RoughtimePort)
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	fmt.Println("Listening for Roughtime on", pc.LocalAddr())
+	return s.Serve(pc)
+}
+
+// Serve answers Roughtime requests arriving on pc until reading fails.
+func (s *RoughtimeServer) Serve(pc net.PacketConn) error {
+	buf := make([]byte, MaxPacketSize)
+	for {
+		batch, err := s.readBatch(pc, buf)
+		if err != nil {
+			return err
+		}
+		if len(batch) > 0 {
+			s.respond(pc, batch)
+		}
+	}
+}
+
+// readBatch blocks for the first valid request and then collects more until
+// the batch is full or Wait has passed.
+func (s *RoughtimeServer) readBatch(pc net.PacketConn, buf []byte) ([]roughtimeRequest, error) {
+	max := s.Batch
+	if max <= 0 {
+		max = DefaultRoughtimeBatch
+	}
+	wait := s.Wait
+	if wait <= 0 {
+		wait = DefaultRoughtimeWait
+	}
+	var batch []roughtimeRequest
+	defer pc.SetReadDeadline(time.Time{})
+	for len(batch) < max {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if len(batch) > 0 && errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		if n < roughtimeMinRequestSize {
+			continue
+		}
+		msg, err := parseRoughtimeMessage(buf[:n])
+		if err != nil || len(msg[tagNONC]) != roughtimeNonceSize {
+			continue
+		}
+		if len(batch) == 0 {
+			pc.SetReadDeadline(time.Now().Add(wait))
+		}
+		batch = append(batch, roughtimeRequest{addr: addr, nonce: append([]byte(nil), msg[tagNONC]...)})
+	}
+	return batch, nil
+}
+
+// respond signs one SREP for the batch and sends every client its Merkle
+// path.
+func (s *RoughtimeServer) respond(pc net.PacketConn, batch []roughtimeRequest) {
+	now := s.Service.Now()
+	if !s.Service.Sync.Synchronized(now) {
+		return
+	}
+	var served []roughtimeRequest
+	for _, req := range batch {
+		var ip net.IP
+		if a, ok := req.addr.(*net.UDPAddr); ok {
+			ip = a.IP
+		}
+		// KoD无法在Roughtime中表达，一律按丢弃处理
+		if s.Policy.Decide(ip, now) == PolicyServe {
+			served = append(served, req)
+		}
+	}
+	if len(served) == 0 {
+		return
+	}
+	online, err := s.onlineKey(now)
+	if err != nil {
+		fmt.Println("Roughtime online key:", err)
+		return
+	}
+
+	leaves := make([][]byte, len(served))
+	for i, req := range served {
+		leaves[i] = req.nonce
+	}
+	tree := newRoughtimeTree(leaves)
+	radius := s.Service.SystemVars(now).RootDistance()
+	if radius < roughtimeMinRadius {
+		radius = roughtimeMinRadius
+	}
+	srep := encodeRoughtimeMessage(map[uint32][]byte{
+		tagRADI: roughtimeUint32(uint32(radius / time.Microsecond)),
+		tagMIDP: roughtimeUint64(uint64(now.UnixNano() / 1000)),
+		tagROOT: tree.root(),
+	})
+	sig := ed25519.Sign(online.key, append([]byte(roughtimeRespContext), srep...))
+
+	for i, req := range served {
+		resp := encodeRoughtimeMessage(map[uint32][]byte{
+			tagSIG:  sig,
+			tagPATH: tree.path(i),
+			tagSREP: srep,
+			tagCERT: online.cert,
+			tagINDX: roughtimeUint32(uint32(i)),
+		})
+		if _, err := pc.WriteTo(resp, req.addr); err != nil {
+			fmt.Println("Error sending Roughtime response:", err)
+		}
+	}
+}
+
+// onlineKey returns the current online key, delegating a new one from the
+// long-term key when it is due. The delegation is valid one Rotate period
+// either side of its own, so clients with a rough clock still accept it.
+func (s *RoughtimeServer) onlineKey(now time.Time) (*roughtimeOnlineKey, error) {
+	if s.online != nil && now.Before(s.online.renewAt) {
+		return s.online, nil
+	}
+	rotate := s.Rotate
+	if rotate <= 0 {
+		rotate = DefaultRoughtimeRotate
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dele := encodeRoughtimeMessage(map[uint32][]byte{
+		tagMINT: roughtimeUint64(uint64(now.Add(-rotate).UnixNano() / 1000)),
+		tagMAXT: roughtimeUint64(uint64(now.Add(2*rotate).UnixNano() / 1000)),
+		tagPUBK: pub,
+	})
+	sig := ed25519.Sign(s.Key, append([]byte(roughtimeDeleContext), dele...))
+	s.online = &roughtimeOnlineKey{
+		key:     priv,
+		cert:    encodeRoughtimeMessage(map[uint32][]byte{tagSIG: sig, tagDELE: dele}),
+		renewAt: now.Add(rotate),
+	}
+	return s.online, nil
+}
+
+// encodeRoughtimeMessage builds a message: the tag count, the offsets of all
+// values but the first, the tags in ascending order, then the values. All
+// numbers are little-endian and every value is a multiple of 4 bytes.
+func encodeRoughtimeMessage(msg map[uint32][]byte) []byte {
+	tags := make([]uint32, 0, len(msg))
+	for tag := range msg {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	out := make([]byte, 4, 8*len(tags))
+	binary.LittleEndian.PutUint32(out, uint32(len(tags)))
+	offset := 0
+	for i, tag := range tags {
+		if i > 0 {
+			out = append(out, roughtimeUint32(uint32(offset))...)
+		}
+		offset += len(msg[tag])
+	}
+	for _, tag := range tags {
+		out = append(out, roughtimeUint32(tag)...)
+	}
+	for _, tag := range tags {
+		out = append(out, msg[tag]...)
+	}
+	return out
+}
+
+// parseRoughtimeMessage splits a message into its values, checking that the
+// tags are ascending and the offsets are aligned and in range.
+func parseRoughtimeMessage(b []byte) (map[uint32][]byte, error) {
+	if len(b) < 4 || len(b)%4 != 0 {
+		return nil, ErrRoughtimeMessage
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n == 0 || n > (len(b)-4)/8+1 {
+		return nil, ErrRoughtimeMessage
+	}
+	header := 4 + 4*(n-1) + 4*n
+	if header > len(b) {
+		return nil, ErrRoughtimeMessage
+	}
+	values := b[header:]
+	msg := make(map[uint32][]byte, n)
+	start := 0
+	var prev uint32
+	for i := 0; i < n; i++ {
+		end := len(values)
+		if i < n-1 {
+			end = int(binary.LittleEndian.Uint32(b[4+4*i:]))
+		}
+		tag := binary.LittleEndian.Uint32(b[4+4*(n-1)+4*i:])
+		if end%4 != 0 || end < start || end > len(values) || i > 0 && tag <= prev {
+			return nil, ErrRoughtimeMessage
+		}
+		msg[tag] = values[start:end]
+		start, prev = end, tag
+	}
+	return msg, nil
+}
+
+// roughtimeTree is a SHA-512 Merkle tree over the request nonces. Leaves
+// and inner nodes are hashed with different prefixes; the leaf count is
+// padded to a power of two by repeating the last leaf.
+type roughtimeTree struct {
+	levels [][][]byte //levels[0]为叶子，最后一层为根
+}
+
+func newRoughtimeTree(leaves [][]byte) *roughtimeTree {
+	size := 1
+	for size < len(leaves) {
+		size *= 2
+	}
+	level := make([][]byte, size)
+	for i := range level {
+		leaf := leaves[len(leaves)-1]
+		if i < len(leaves) {
+			leaf = leaves[i]
+		}
+		level[i] = roughtimeHash(roughtimeLeafPrefix, leaf)
+	}
+	t := &roughtimeTree{levels: [][][]byte{level}}
+	for len(level) > 1 {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = roughtimeHash(roughtimeNodePrefix, level[2*i], level[2*i+1])
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+func (t *roughtimeTree) root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// path returns the sibling hashes from leaf i up to the root.
+func (t *roughtimeTree) path(i int) []byte {
+	var out []byte
+	for _, level := range t.levels[:len(t.levels)-1] {
+		out = append(out, level[i^1]...)
+		i /= 2
+	}
+	return out
+}
+
+func roughtimeHash(prefix byte, parts ...[]byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{prefix})
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func roughtimeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func roughtimeUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
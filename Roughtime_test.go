@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// tagPAD pads requests up to roughtimeMinRequestSize.
+const tagPAD uint32 = 'P' | 'A'<<8 | 'D'<<16 | 0xff<<24
+
+func TestRoughtimeMessageRoundTrip(t *testing.T) {
+	msg := map[uint32][]byte{
+		tagNONC: bytes.Repeat([]byte{1}, roughtimeNonceSize),
+		tagSIG:  bytes.Repeat([]byte{2}, 64),
+		tagINDX: roughtimeUint32(7),
+		tagPATH: nil,
+	}
+	got, err := parseRoughtimeMessage(encodeRoughtimeMessage(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(msg) {
+		t.Fatalf("%d tags, want %d", len(got), len(msg))
+	}
+	for tag, v := range msg {
+		if !bytes.Equal(got[tag], v) {
+			t.Errorf("tag %#08x: % x, want % x", tag, got[tag], v)
+		}
+	}
+}
+
+func TestRoughtimeMessageMalformed(t *testing.T) {
+	// le 把32位小端整数拼成报文
+	le := func(words ...uint32) []byte {
+		var b []byte
+		for _, w := range words {
+			b = append(b, roughtimeUint32(w)...)
+		}
+		return b
+	}
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"empty", nil},
+		{"length not a multiple of 4", []byte{1, 0, 0, 0, 0}},
+		{"no tags", le(0)},
+		{"tag count beyond message", le(1000, 0, 0)},
+		{"truncated header", le(2, 4, tagSIG)},
+		{"tags not ascending", le(2, 4, tagNONC, tagSIG, 0, 0)},
+		{"duplicate tags", le(2, 4, tagSIG, tagSIG, 0, 0)},
+		{"offset not aligned", le(2, 2, tagSIG, tagNONC, 0, 0)},
+		{"offset beyond values", le(2, 12, tagSIG, tagNONC, 0, 0)},
+		{"offsets descending", le(3, 8, 4, tagSIG, tagNONC, tagPATH, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		if _, err := parseRoughtimeMessage(tt.msg); err != ErrRoughtimeMessage {
+			t.Errorf("%s: err %v, want %v", tt.name, err, ErrRoughtimeMessage)
+		}
+	}
+}
+
+// verifyRoughtimePath folds the sibling hashes in path into the hash of
+// nonce, taking the left or right side from the bits of index, and
+// reports whether the result is root.
+func verifyRoughtimePath(nonce, path []byte, index uint32, root []byte) bool {
+	if len(path)%sha512.Size != 0 {
+		return false
+	}
+	cur := roughtimeHash(roughtimeLeafPrefix, nonce)
+	for ; len(path) > 0; path = path[sha512.Size:] {
+		sib := path[:sha512.Size]
+		if index&1 == 0 {
+			cur = roughtimeHash(roughtimeNodePrefix, cur, sib)
+		} else {
+			cur = roughtimeHash(roughtimeNodePrefix, sib, cur)
+		}
+		index >>= 1
+	}
+	return index == 0 && bytes.Equal(cur, root)
+}
+
+func TestRoughtimeTreePaths(t *testing.T) {
+	for _, size := range []int{1, 3, 64} {
+		leaves := make([][]byte, size)
+		for i := range leaves {
+			leaves[i] = bytes.Repeat([]byte{byte(i)}, roughtimeNonceSize)
+		}
+		tree := newRoughtimeTree(leaves)
+		for i, leaf := range leaves {
+			if !verifyRoughtimePath(leaf, tree.path(i), uint32(i), tree.root()) {
+				t.Errorf("batch of %d: path of leaf %d does not lead to the root", size, i)
+			}
+		}
+		if size > 1 && verifyRoughtimePath(leaves[0], tree.path(1), 1, tree.root()) {
+			t.Errorf("batch of %d: leaf 0 verified with the path of leaf 1", size)
+		}
+	}
+}
+
+// TestRoughtimeLoopback sends one batch of requests to a server on
+// 127.0.0.1 and checks every response the way a client does: the
+// delegation against the long-term key, the SREP against the delegated
+// key, the nonce against ROOT, and MIDP against the delegation's validity.
+func TestRoughtimeLoopback(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ntp := &NTPService{Sync: &SyncState{}}
+	ntp.Sync.Set(SyncUpdate{Source: net.IPv4(192, 0, 2, 1), Stratum: 1}, time.Now())
+	longTerm := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	server := &RoughtimeServer{Service: ntp, Key: longTerm, Batch: 3, Wait: time.Second}
+	go server.Serve(pc)
+
+	const clients = 3
+	conns := make([]*net.UDPConn, clients)
+	nonces := make([][]byte, clients)
+	for i := range conns {
+		conn, err := net.DialUDP("udp4", nil, pc.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+		nonces[i] = bytes.Repeat([]byte{byte(i + 1)}, roughtimeNonceSize)
+		req := encodeRoughtimeMessage(map[uint32][]byte{
+			tagNONC: nonces[i],
+			tagPAD:  make([]byte, roughtimeMinRequestSize-4-4-8-roughtimeNonceSize),
+		})
+		if len(req) != roughtimeMinRequestSize {
+			t.Fatalf("request of %d bytes", len(req))
+		}
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var roots [][]byte
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, MaxPacketSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		resp := mustParseRoughtime(t, buf[:n])
+		cert := mustParseRoughtime(t, resp[tagCERT])
+		dele := mustParseRoughtime(t, cert[tagDELE])
+		if !ed25519.Verify(longTerm.Public().(ed25519.PublicKey), append([]byte(roughtimeDeleContext), cert[tagDELE]...), cert[tagSIG]) {
+			t.Fatalf("client %d: DELE signature does not verify", i)
+		}
+		if !ed25519.Verify(ed25519.PublicKey(dele[tagPUBK]), append([]byte(roughtimeRespContext), resp[tagSREP]...), resp[tagSIG]) {
+			t.Fatalf("client %d: SREP signature does not verify", i)
+		}
+		srep := mustParseRoughtime(t, resp[tagSREP])
+		if len(resp[tagINDX]) != 4 || !verifyRoughtimePath(nonces[i], resp[tagPATH], binary.LittleEndian.Uint32(resp[tagINDX]), srep[tagROOT]) {
+			t.Errorf("client %d: nonce does not lead to ROOT through PATH and INDX", i)
+		}
+		roots = append(roots, srep[tagROOT])
+
+		midp := binary.LittleEndian.Uint64(srep[tagMIDP])
+		mint := binary.LittleEndian.Uint64(dele[tagMINT])
+		maxt := binary.LittleEndian.Uint64(dele[tagMAXT])
+		if midp < mint || midp > maxt {
+			t.Errorf("client %d: MIDP %d outside MINT %d MAXT %d", i, midp, mint, maxt)
+		}
+		if d := time.Since(time.UnixMicro(int64(midp))); d < 0 || d > 2*time.Second {
+			t.Errorf("client %d: MIDP %v from now", i, d)
+		}
+		if radi := binary.LittleEndian.Uint32(srep[tagRADI]); time.Duration(radi)*time.Microsecond < roughtimeMinRadius {
+			t.Errorf("client %d: RADI %dµs below the minimum", i, radi)
+		}
+	}
+	for _, root := range roots[1:] {
+		if !bytes.Equal(root, roots[0]) {
+			t.Error("requests in one batch were signed under different roots")
+		}
+	}
+}
+
+func mustParseRoughtime(t *testing.T, b []byte) map[uint32][]byte {
+	t.Helper()
+	msg, err := parseRoughtimeMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// RFC 5905 clock filter and mitigation parameters
+const (
+	filterStages  = 8                       //NSTAGE 时钟滤波器级数
+	minSurvivors  = 3                       //NMIN 聚类后至少保留的源数
+	maxDistance   = 1500 * time.Millisecond //MAXDIST 根距离超过此值的源不参与选择
+	minDispersion = time.Millisecond        //MINDISP
+)
+
+// SelectStatus is the outcome of source selection for an association. The
+// values are the select codes ntpq shows in the peer status word.
+type SelectStatus uint8
+
+const (
+	SelectReject      SelectStatus = 0 //不可用：不可达、未同步或根距离过大
+	SelectFalseticker SelectStatus = 1 //不在多数源的交集内
+	SelectOutlier     SelectStatus = 3 //聚类时被剔除
+	SelectCandidate   SelectStatus = 4 //参与加权合成
+	SelectSystemPeer  SelectStatus = 6 //当前同步源
+)
+
+func (s SelectStatus) String() string {
+	switch s {
+	case SelectFalseticker:
+		return "falseticker"
+	case SelectOutlier:
+		return "outlier"
+	case SelectCandidate:
+		return "candidate"
+	case SelectSystemPeer:
+		return "selected"
+	}
+	return "reject"
+}
+
+// filterSample is one stage of the clock filter. offset is measured against
+// the local Clock, not the served time, so samples taken before and after a
+// change of Service.Sync stay comparable.
+type filterSample struct {
+	offset time.Duration
+	delay  time.Duration
+	disp   time.Duration
+	time   time.Time
+}
+
+// clockFilter adds a sample to the shift register and recomputes the
+// association's offset, delay, dispersion and jitter from the sample with
+// the lowest delay (RFC 5905 10). It reports whether that sample is newer
+// than the one used last time; an older one carries no new information.
+//
+// RFC 5905 fills empty stages with MAXDISP, which keeps a new source out of
+// selection for several polls; here only filled stages are weighted so the
+// first sample can be used at once.
+func (a *Association) clockFilter(offset, delay time.Duration, now time.Time) bool {
+	copy(a.filter[1:], a.filter[:filterStages-1])
+	a.filter[0] = filterSample{
+		offset: offset,
+		delay:  delay,
+		disp:   clockPrecision + time.Duration(float64(delay)*MaxClockDrift),
+		time:   now,
+	}
+	if a.filterLen < filterStages {
+		a.filterLen++
+	}
+
+	stages := make([]filterSample, a.filterLen)
+	copy(stages, a.filter[:a.filterLen])
+	for i := range stages {
+		stages[i].disp += time.Duration(float64(now.Sub(stages[i].time)) * MaxClockDrift)
+	}
+	sort.SliceStable(stages, func(i, j int) bool { return stages[i].delay < stages[j].delay })
+
+	best := stages[0]
+	var disp, jitter float64
+	for i, s := range stages {
+		disp += float64(s.disp) / float64(uint(2)<<uint(i))
+		if i > 0 {
+			d := float64(s.offset - best.offset)
+			jitter += d * d
+		}
+	}
+	if len(stages) > 1 {
+		jitter = math.Sqrt(jitter / float64(len(stages)-1))
+	}
+	a.Dispersion = time.Duration(disp)
+	a.Jitter = time.Duration(jitter)
+	if a.Jitter < clockPrecision {
+		a.Jitter = clockPrecision
+	}
+	a.Delay = best.delay
+	a.clockOffset = best.offset
+
+	if !best.time.After(a.filterUsed) {
+		return false
+	}
+	a.filterUsed = best.time
+	return true
+}
+
+// syncDistance is the root distance used to select and weight sources:
+// the error bound of the association's time relative to the primary
+// reference at now.
+func (a *Association) syncDistance(now time.Time) time.Duration {
+	delay := a.RootDelay + a.Delay
+	if delay < minDispersion {
+		delay = minDispersion
+	}
+	age := time.Duration(float64(now.Sub(a.Updated)) * MaxClockDrift)
+	return delay/2 + a.RootDisp + a.Dispersion + a.Jitter + age
+}
+
+// selectSources runs selection, clustering and combining over the upstream
+// servers, symmetric peers and broadcast servers and hands the result to
+// Service.Sync (RFC 5905 11.2). The caller holds m.mu.
+func (m *AssociationManager) selectSources(now time.Time) {
+	local := localRefIDs()
+	var candidates []*Association
+	for _, a := range m.assocs {
+		a.Select = SelectReject
+		if a.Reach == 0 || a.Leap == LeapNotInSync || a.Stratum == 0 || a.Stratum >= maxStratum || a.syncDistance(now) > maxDistance {
+			continue
+		}
+		if a.HostMode != ModeClient && local[a.RefID] {
+			continue //对等体正从本机同步，选它会形成时间环路
+		}
+		candidates = append(candidates, a)
+	}
+	survivors := intersect(candidates, now)
+	survivors = cluster(survivors, now)
+	if len(survivors) == 0 {
+		m.Service.debugln("No time source selected,", len(candidates), "candidates")
+		return //保持上一次的结果直到holdover结束
+	}
+	sysPeer := survivors[0]
+	sysPeer.Select = SelectSystemPeer
+	m.sysPeer = sysPeer.ID
+
+	// 按根距离的倒数加权合成偏差和抖动
+	var sumWeight, sumOffset, sumJitter float64
+	for _, a := range survivors {
+		w := 1 / float64(a.syncDistance(now))
+		sumWeight += w
+		sumOffset += w * float64(a.clockOffset)
+		d := float64(a.clockOffset - sysPeer.clockOffset)
+		sumJitter += w * d * d
+	}
+	offset := time.Duration(sumOffset / sumWeight)
+	m.sysJitter = time.Duration(math.Sqrt(sumJitter / sumWeight))
+
+	m.Service.Sync.Set(SyncUpdate{
+		Offset:    offset,
+		Source:    sysPeer.Addr.IP,
+		Stratum:   sysPeer.Stratum,
+		RootDelay: sysPeer.RootDelay + sysPeer.Delay,
+		RootDisp:  sysPeer.RootDisp + sysPeer.Dispersion + sysPeer.Jitter + m.sysJitter,
+	}, now)
+	m.Service.debugf("selected %s offset %v from %d of %d candidates\n", sysPeer.Addr, offset, len(survivors), len(candidates))
+}
+
+// localRefIDs returns the reference IDs a peer would publish while
+// synchronised to this host, one per local address (RFC 5905 13).
+func localRefIDs() map[uint32]bool {
+	ids := make(map[uint32]bool)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ids
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ids[refIDFromIP(ipnet.IP)] = true
+		}
+	}
+	return ids
+}
+
+// intersect is the Marzullo-style intersection of RFC 5905 11.2.1: find the
+// smallest interval containing points from the largest number of
+// correctness intervals [offset-distance, offset+distance]. Candidates
+// whose offset lies outside it are falsetickers. It returns the
+// truechimers, or nil when no majority agrees.
+func intersect(candidates []*Association, now time.Time) []*Association {
+	type endpoint struct {
+		edge time.Duration
+		typ  int //-1 下端 0 中点 +1 上端
+	}
+	n := len(candidates)
+	points := make([]endpoint, 0, 3*n)
+	for _, a := range candidates {
+		dist := a.syncDistance(now)
+		points = append(points,
+			endpoint{a.clockOffset - dist, -1},
+			endpoint{a.clockOffset, 0},
+			endpoint{a.clockOffset + dist, +1})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].edge < points[j].edge })
+
+	var low, high time.Duration
+	ok := false
+	for allow := 0; 2*allow < n; allow++ {
+		found, chime := 0, 0
+		for _, p := range points {
+			chime -= p.typ
+			if chime >= n-allow {
+				low = p.edge
+				break
+			}
+			if p.typ == 0 {
+				found++
+			}
+		}
+		chime = 0
+		for i := len(points) - 1; i >= 0; i-- {
+			chime += points[i].typ
+			if chime >= n-allow {
+				high = points[i].edge
+				break
+			}
+			if points[i].typ == 0 {
+				found++
+			}
+		}
+		if found > allow {
+			continue
+		}
+		if high > low {
+			ok = true
+			break
+		}
+	}
+
+	var truechimers []*Association
+	for _, a := range candidates {
+		if !ok || a.clockOffset < low || a.clockOffset > high {
+			a.Select = SelectFalseticker
+			continue
+		}
+		a.Select = SelectCandidate
+		truechimers = append(truechimers, a)
+	}
+	return truechimers
+}
+
+// cluster implements RFC 5905 11.2.2: sort the truechimers by stratum and
+// distance, then repeatedly drop the one adding the most selection jitter
+// until that is smaller than the best source jitter or only minSurvivors
+// remain. The first of the returned survivors is the system peer.
+func cluster(survivors []*Association, now time.Time) []*Association {
+	metric := func(a *Association) time.Duration {
+		return time.Duration(a.Stratum)*maxDistance + a.syncDistance(now)
+	}
+	sort.SliceStable(survivors, func(i, j int) bool { return metric(survivors[i]) < metric(survivors[j]) })
+	for len(survivors) > minSurvivors {
+		worst, maxSelJitter := 0, 0.0
+		minPeerJitter := time.Duration(math.MaxInt64)
+		for i, a := range survivors {
+			var sum float64
+			for _, b := range survivors {
+				d := float64(a.clockOffset - b.clockOffset)
+				sum += d * d
+			}
+			if jitter := math.Sqrt(sum / float64(len(survivors)-1)); jitter > maxSelJitter {
+				worst, maxSelJitter = i, jitter
+			}
+			if a.Jitter < minPeerJitter {
+				minPeerJitter = a.Jitter
+			}
+		}
+		if maxSelJitter <= float64(minPeerJitter) {
+			break
+		}
+		survivors[worst].Select = SelectOutlier
+		survivors = append(survivors[:worst], survivors[worst+1:]...)
+	}
+	return survivors
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// feed gives a an upstream state and one clock filter sample at now.
+func feed(a *Association, stratum uint8, refID uint32, offset time.Duration, now time.Time) {
+	a.Reach |= 1
+	a.Stratum = stratum
+	a.RefID = refID
+	a.RootDelay = 2 * time.Millisecond
+	a.RootDisp = time.Millisecond
+	a.Updated = now
+	a.clockFilter(offset, time.Millisecond, now)
+}
+
+func newTestManager(t *testing.T) (*AssociationManager, *Association, *Association) {
+	t.Helper()
+	m := NewAssociationManager(&NTPService{Sync: &SyncState{}}, nil)
+	server, err := m.AddServer(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := m.AddPeer(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 123}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, server, peer
+}
+
+func TestSelectPrefersServerOverPeer(t *testing.T) {
+	m, server, peer := newTestManager(t)
+	now := time.Now()
+	feed(server, 1, refIDFromCode("GPS"), 20*time.Millisecond, now)
+	feed(peer, 2, refIDFromIP(net.IPv4(198, 51, 100, 1)), 21*time.Millisecond, now)
+	m.selectSources(now)
+	if server.Select != SelectSystemPeer || peer.Select != SelectCandidate {
+		t.Errorf("server %v peer %v, want selected and candidate", server.Select, peer.Select)
+	}
+}
+
+func TestSelectPeerAsBackup(t *testing.T) {
+	m, server, peer := newTestManager(t)
+	now := time.Now()
+	feed(server, 1, refIDFromCode("GPS"), 20*time.Millisecond, now)
+	server.Reach = 0 //上游不可达
+	feed(peer, 2, refIDFromIP(net.IPv4(198, 51, 100, 1)), 30*time.Millisecond, now)
+	m.selectSources(now)
+	if peer.Select != SelectSystemPeer || server.Select != SelectReject {
+		t.Fatalf("server %v peer %v, want reject and selected", server.Select, peer.Select)
+	}
+	last, _ := m.Service.Sync.Last()
+	if !last.Source.Equal(peer.Addr.IP) || last.Stratum != 2 || last.Offset != 30*time.Millisecond {
+		t.Errorf("sync %+v, want offset 30ms from the peer", last)
+	}
+}
+
+func TestSelectRejectsPeerSyncedToUs(t *testing.T) {
+	m, _, peer := newTestManager(t)
+	now := time.Now()
+	feed(peer, 3, refIDFromIP(loopback), 30*time.Millisecond, now)
+	m.selectSources(now)
+	if peer.Select != SelectReject {
+		t.Errorf("peer synchronised to us: %v, want reject", peer.Select)
+	}
+	if m.Service.Sync.Synchronized(now) {
+		t.Error("synchronised to a peer that takes its time from us")
+	}
+}
+
+// TestPeerExchangeLoopback runs a symmetric active/passive exchange between
+// two managers on 127.0.0.1 and checks that the active side selects the
+// passive one as its time source.
+func TestPeerExchangeLoopback(t *testing.T) {
+	keys := NewKeyStore()
+	keys.Add(&SymmetricKey{ID: 1, Type: KeyTypeMD5, Secret: []byte("peerkey")})
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		return conn
+	}
+	connA, connB := listen(), listen()
+	a := NewAssociationManager(&NTPService{Keys: keys, Sync: &SyncState{}}, connA)
+	b := NewAssociationManager(&NTPService{Keys: keys}, connB)
+	assoc, err := a.AddPeer(connB.LocalAddr().(*net.UDPAddr), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver := func(to *AssociationManager, conn *net.UDPConn) {
+		buf := make([]byte, MaxPacketSize)
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		to.HandlePacket(buf[:n], from, to.Service.Now())
+	}
+
+	a.poll(time.Now()) //A 主动发送
+	deliver(b, connB)  //B 建立被动关联并立即回复
+	deliver(a, connA)  //A 得到样本并做时钟选择
+
+	if assoc.Reach&1 == 0 || assoc.Stratum != localStratum {
+		t.Fatalf("reach %03o stratum %d, want a sample at stratum %d", assoc.Reach, assoc.Stratum, localStratum)
+	}
+	if assoc.Select != SelectSystemPeer {
+		t.Fatalf("peer status %v, want selected", assoc.Select)
+	}
+	last, _ := a.Service.Sync.Last()
+	if !last.Source.Equal(loopback) || last.Offset < -10*time.Millisecond || last.Offset > 10*time.Millisecond {
+		t.Errorf("sync %+v, want a small offset from %v", last, loopback)
+	}
+	if len(b.Associations()) != 1 || b.Associations()[0].HostMode != ModeSymmetricPassive {
+		t.Errorf("B associations %+v, want one passive peer", b.Associations())
+	}
+}
+
+// TestPeerKissNeedsOrigin checks that a kiss-o'-death only counts when it
+// answers our last request, so an off-path sender cannot demobilize a
+// server or slow down its polling.
+func TestPeerKissNeedsOrigin(t *testing.T) {
+	m, server, _ := newTestManager(t)
+	server.xmt = NewNtpTimestamp(time.Now().Add(-time.Second))
+	org := server.org
+	kod := func(origin NtpTimestamp, code string) []byte {
+		t.Helper()
+		resp, err := CreateKoDResponse(NTPv4Packet{Version: 4, Mode: ModeClient, TransmitTimestamp: origin}, 123, code, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		StampTransmitTimestamp(resp, time.Now())
+		return resp
+	}
+
+	poll := server.Poll
+	for _, origin := range []NtpTimestamp{0, server.xmt + 1} {
+		m.HandlePacket(kod(origin, KissRate), server.Addr, time.Now())
+		m.HandlePacket(kod(origin, KissDeny), server.Addr, time.Now())
+	}
+	if !m.Has(server.Addr) || server.Poll != poll {
+		t.Fatalf("spoofed KoD: associated %v poll %v, want %v", m.Has(server.Addr), server.Poll, poll)
+	}
+	if server.org != org {
+		t.Error("bogus packet overwrote the origin timestamp")
+	}
+
+	m.HandlePacket(kod(server.xmt, KissRate), server.Addr, time.Now())
+	if server.Poll != 2*poll {
+		t.Errorf("RATE: poll %v, want %v", server.Poll, 2*poll)
+	}
+	m.HandlePacket(kod(server.xmt, KissDeny), server.Addr, time.Now())
+	if m.Has(server.Addr) {
+		t.Error("DENY answering our request did not demobilize the server")
+	}
+}
+
+// newServers returns a manager with one stratum 1 server per offset, each
+// with a single sample and the given root dispersion.
+func newServers(t *testing.T, now time.Time, rootDisp time.Duration, offsets ...time.Duration) (*AssociationManager, []*Association) {
+	t.Helper()
+	m := NewAssociationManager(&NTPService{Sync: &SyncState{}}, nil)
+	var servers []*Association
+	for i, offset := range offsets {
+		a, err := m.AddServer(&net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 123}, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		feed(a, 1, refIDFromCode("GPS"), offset, now)
+		a.RootDisp = rootDisp
+		servers = append(servers, a)
+	}
+	return m, servers
+}
+
+func TestSelectIntersectAndCluster(t *testing.T) {
+	const ms = time.Millisecond
+	const survivor = SelectCandidate //候选或被选中的源
+	tests := []struct {
+		name     string
+		rootDisp time.Duration
+		offsets  []time.Duration
+		want     []SelectStatus
+	}{
+		{"falseticker", ms, []time.Duration{0, 1 * ms, 2 * ms, 500 * ms},
+			[]SelectStatus{survivor, survivor, survivor, SelectFalseticker}},
+		{"no majority", ms, []time.Duration{0, 1 * ms, 500 * ms, 501 * ms},
+			[]SelectStatus{SelectFalseticker, SelectFalseticker, SelectFalseticker, SelectFalseticker}},
+		{"cluster down to minSurvivors", 50 * ms, []time.Duration{0, 1 * ms, 2 * ms, 4 * ms, 20 * ms},
+			[]SelectStatus{survivor, survivor, survivor, SelectOutlier, SelectOutlier}},
+	}
+	for _, tt := range tests {
+		now := time.Now()
+		m, servers := newServers(t, now, tt.rootDisp, tt.offsets...)
+		m.selectSources(now)
+		selected := 0
+		for i, a := range servers {
+			got := a.Select
+			if got == SelectSystemPeer {
+				selected++
+				got = survivor
+			}
+			if got != tt.want[i] {
+				t.Errorf("%s: server at %v is %v, want %v", tt.name, tt.offsets[i], a.Select, tt.want[i])
+			}
+		}
+		wantSync, wantSelected := tt.want[0] == survivor, 0
+		if wantSync {
+			wantSelected = 1
+		}
+		if synced := m.Service.Sync.Synchronized(now); selected != wantSelected || synced != wantSync {
+			t.Errorf("%s: %d selected, synchronised %v; want %d, %v", tt.name, selected, synced, wantSelected, wantSync)
+		}
+	}
+}
+
+// TestSelectCombinedOffset checks that the survivors' offsets are combined
+// weighted by the inverse of their root distance.
+func TestSelectCombinedOffset(t *testing.T) {
+	now := time.Now()
+	m, servers := newServers(t, now, time.Millisecond, 10*time.Millisecond, 14*time.Millisecond)
+	servers[1].RootDisp = 4 * time.Millisecond //第二个源的根距离更大，权重更小
+	m.selectSources(now)
+	var sumWeight, sumOffset float64
+	for _, a := range servers {
+		if a.Select != SelectCandidate && a.Select != SelectSystemPeer {
+			t.Fatalf("server at %v is %v, want both to survive", a.clockOffset, a.Select)
+		}
+		w := 1 / float64(a.syncDistance(now))
+		sumWeight += w
+		sumOffset += w * float64(a.clockOffset)
+	}
+	last, _ := m.Service.Sync.Last()
+	want := time.Duration(sumOffset / sumWeight)
+	if d := last.Offset - want; d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("combined offset %v, want %v", last.Offset, want)
+	}
+	if last.Offset <= 10*time.Millisecond || last.Offset >= 12*time.Millisecond {
+		t.Errorf("combined offset %v, want closer to the nearer source's 10ms", last.Offset)
+	}
+	if servers[0].Select != SelectSystemPeer || !last.Source.Equal(servers[0].Addr.IP) {
+		t.Errorf("system peer %v, want the server with the smaller distance", last.Source)
+	}
+}
@@ -0,0 +1,144 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// Linux socket options missing from package syscall
+const (
+	ipMulticastAll   = 49 //IP_MULTICAST_ALL
+	ipv6MulticastAll = 29 //IPV6_MULTICAST_ALL
+)
+
+// setMulticastOptions sets the multicast TTL (hop limit for IPv6) and the
+// outgoing interface of conn. Loopback of multicast packets stays enabled
+// so a client on the same host receives them.
+func setMulticastOptions(conn *net.UDPConn, ipv6 bool, ttl int, ifi *net.Interface) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		s := int(fd)
+		if ipv6 {
+			if serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl); serr != nil {
+				return
+			}
+			if ifi != nil {
+				serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+			}
+			return
+		}
+		if serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl); serr != nil {
+			return
+		}
+		if ifi != nil {
+			serr = syscall.SetsockoptIPMreqn(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(ifi.Index)})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// joinMulticastGroup joins group on conn so packets sent to the group reach
+// the socket; ifi selects the interface, nil lets the kernel choose.
+func joinMulticastGroup(conn *net.UDPConn, group net.IP, ifi *net.Interface) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	index := 0
+	if ifi != nil {
+		index = ifi.Index
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ip4 := group.To4(); ip4 != nil {
+			mreq := &syscall.IPMreqn{Ifindex: int32(index)}
+			copy(mreq.Multiaddr[:], ip4)
+			serr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+			return
+		}
+		mreq := &syscall.IPv6Mreq{Interface: uint32(index)}
+		copy(mreq.Multiaddr[:], group.To16())
+		serr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// shareMulticastControl is a net.ListenConfig Control function for the main
+// socket when a manycast group socket shares port 123 with it: SO_REUSEADDR
+// lets both bind the port, and IP_MULTICAST_ALL=0 keeps traffic for groups
+// joined by other sockets off the wildcard socket.
+func shareMulticastControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		s := int(fd)
+		if serr = syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); serr != nil {
+			return
+		}
+		if serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, ipMulticastAll, 0); serr != nil {
+			return
+		}
+		if network != "udp4" {
+			serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, ipv6MulticastAll, 0)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// listenMulticastGroup opens a UDP socket bound to the group address itself
+// and joins the group, so it only receives packets sent to the group.
+// net.ListenMulticastUDP binds the wildcard address instead, which would
+// take unicast requests away from the main socket on the same port.
+func listenMulticastGroup(group *net.UDPAddr, ifi *net.Interface) (*net.UDPConn, error) {
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := group.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: group.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: group.Port}
+		copy(sa6.Addr[:], group.IP.To16())
+		sa = sa6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(fd), "multicast "+group.String())
+	defer f.Close() //FilePacketConn复制了描述符
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	if err := joinMulticastGroup(conn, group.IP, ifi); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
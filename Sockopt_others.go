@@ -0,0 +1,34 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errSockoptUnsupported = errors.New("socket option not supported on this platform")
+
+// setMulticastOptions is only implemented on Linux; elsewhere the system
+// defaults (TTL 1, default interface) apply.
+func setMulticastOptions(conn *net.UDPConn, ipv6 bool, ttl int, ifi *net.Interface) error {
+	return errSockoptUnsupported
+}
+
+// joinMulticastGroup is only implemented on Linux.
+func joinMulticastGroup(conn *net.UDPConn, group net.IP, ifi *net.Interface) error {
+	return errSockoptUnsupported
+}
+
+// shareMulticastControl is a no-op outside Linux; binding a manycast group
+// socket next to the main socket may then fail.
+func shareMulticastControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// listenMulticastGroup falls back to net.ListenMulticastUDP, which binds
+// the wildcard address; run the manycast server on its own address there.
+func listenMulticastGroup(group *net.UDPAddr, ifi *net.Interface) (*net.UDPConn, error) {
+	return net.ListenMulticastUDP("udp", ifi, group)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ServerStats counts the client requests answered, per NTP version, for
+// "ntpq -c sysstats" and the startup log.
+type ServerStats struct {
+	versions [maxNtpVersion + 1]uint64 //按版本号计数，下标0不用；放在首位保证32位平台上的原子操作对齐
+	Started  time.Time
+}
+
+// countRequest records a request of the given version. A nil ServerStats
+// counts nothing.
+func (s *ServerStats) countRequest(version uint8) {
+	if s == nil || version < minNtpVersion || version > maxNtpVersion {
+		return
+	}
+	atomic.AddUint64(&s.versions[version], 1)
+}
+
+// Requests returns the number of requests received with the given version.
+func (s *ServerStats) Requests(version uint8) uint64 {
+	if s == nil || version < minNtpVersion || version > maxNtpVersion {
+		return 0
+	}
+	return atomic.LoadUint64(&s.versions[version])
+}
+
+// Total returns the number of requests of all versions.
+func (s *ServerStats) Total() uint64 {
+	var total uint64
+	for v := minNtpVersion; v <= maxNtpVersion; v++ {
+		total += s.Requests(v)
+	}
+	return total
+}
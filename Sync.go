@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxClockDrift is the frequency tolerance assumed for the local clock
+// between updates, PHI in RFC 5905 (15 PPM).
+const MaxClockDrift = 15e-6
+
+// SyncUpdate is one measurement against an external time source.
+type SyncUpdate struct {
+	Offset    time.Duration //时间源 - 本地时钟
+	Source    net.IP        //时间源地址，作为Reference ID发布
+	Stratum   uint8         //时间源的stratum
+	RootDelay time.Duration //经时间源到主参考源的总往返延迟
+	RootDisp  time.Duration //经时间源到主参考源的总离散度
+}
+
+// SyncState is the result of synchronising to an external time source: how
+// far the source is ahead of the local Clock. A nil SyncState means the
+// local clock is trusted as is.
+type SyncState struct {
+	// Holdover is how long the last offset stays valid without an update;
+	// zero keeps it forever.
+	Holdover time.Duration
+
+	mu      sync.RWMutex
+	last    SyncUpdate
+	updated time.Time //最近一次更新的本地时间，零值表示尚未同步
+}
+
+// Set records a new measurement taken at now.
+func (s *SyncState) Set(u SyncUpdate, now time.Time) {
+	s.mu.Lock()
+	s.last, s.updated = u, now
+	s.mu.Unlock()
+}
+
+// Offset returns the offset to add to the local clock.
+func (s *SyncState) Offset() time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.last.Offset
+}
+
+// Last returns the latest measurement and when it was taken.
+func (s *SyncState) Last() (SyncUpdate, time.Time) {
+	if s == nil {
+		return SyncUpdate{}, time.Time{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.last, s.updated
+}
+
+// Synchronized reports whether an offset has been set and is still within
+// the holdover at now.
+func (s *SyncState) Synchronized(now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.updated.IsZero() {
+		return false
+	}
+	return s.Holdover <= 0 || now.Sub(s.updated) <= s.Holdover
+}
+
+// Age returns how long ago the offset was last set, or zero for a nil or
+// never synchronised state.
+func (s *SyncState) Age(now time.Time) time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.updated.IsZero() {
+		return 0
+	}
+	return now.Sub(s.updated)
+}
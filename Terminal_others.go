@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// isTerminal approximates the Linux check with the file mode; /dev/null
+// also counts as a character device here, but the prompt then just times
+// out.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	TimePort      = 37 //RFC 868 Time Protocol (rdate)
+	DaytimePort   = 13 //RFC 867 Daytime Protocol
+	legacyTimeout = 5 * time.Second
+	daytimeLayout = "Monday, January 2, 2006 15:04:05-MST" //RFC 867中的示例格式
+
+	// 策略未配置限速时UDP应答的默认限速，防止被伪造源地址的请求用作反射放大
+	legacyUDPInterval = 2 * time.Second
+	legacyUDPBurst    = 4
+)
+
+// LegacyTimeServer serves the RFC 868 Time and RFC 867 Daytime protocols
+// from the same clock and access policy as NTP. Neither protocol can say
+// that the time is unsynchronised, so nothing is sent while the server has
+// lost its time source; the client times out instead of setting bad time.
+type LegacyTimeServer struct {
+	Service *NTPService
+	Policy  *AccessPolicy
+	Addr    string                 //监听地址，例如 ":37"
+	Format  func(time.Time) []byte //生成应答内容：timeResponse 或 daytimeResponse
+}
+
+// timeResponse is the RFC 868 reply: the seconds since 1900-01-01 as a
+// 32-bit big-endian number, which wraps together with NTP era 0 in 2036.
+func timeResponse(now time.Time) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, NewNtpTimestamp(now).Seconds())
+	return b
+}
+
+// daytimeResponse is the RFC 867 reply: a human readable UTC time line.
+func daytimeResponse(now time.Time) []byte {
+	return []byte(now.UTC().Format(daytimeLayout) + "\r\n")
+}
+
+// ListenAndServe starts the TCP and UDP listeners and serves until one of
+// them fails.
+func (s *LegacyTimeServer) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	fmt.Println("Listening for time requests on tcp/udp", s.Addr)
+	errc := make(chan error, 2)
+	go func() { errc <- s.serveTCP(ln) }()
+	go func() { errc <- s.serveUDP(pc) }()
+	return <-errc
+}
+
+// serveTCP sends the time as soon as a connection is accepted and closes it.
+func (s *LegacyTimeServer) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		now := s.Service.Now()
+		if b := s.response(conn.RemoteAddr(), now); b != nil {
+			conn.SetWriteDeadline(time.Now().Add(legacyTimeout))
+			conn.Write(b)
+		}
+		conn.Close()
+	}
+}
+
+// serveUDP answers any datagram with the time; its content is ignored.
+// The source of a datagram may be forged and the reply is larger than an
+// empty request, so unless the access policy already limits the rate each
+// address is held to legacyUDPBurst replies and one per legacyUDPInterval.
+func (s *LegacyTimeServer) serveUDP(pc net.PacketConn) error {
+	var limit *AccessPolicy
+	if s.Policy == nil || s.Policy.MinInterval <= 0 {
+		limit = &AccessPolicy{MinInterval: legacyUDPInterval, Burst: legacyUDPBurst}
+	}
+	buf := make([]byte, 512)
+	for {
+		_, addr, err := pc.ReadFrom(buf)
+		now := s.Service.Now()
+		if err != nil {
+			return err
+		}
+		if limit != nil && limit.Decide(addr.(*net.UDPAddr).IP, now) != PolicyServe {
+			continue
+		}
+		if b := s.response(addr, now); b != nil {
+			pc.WriteTo(b, addr)
+		}
+	}
+}
+
+// response applies the access policy and sync state and returns the reply
+// for addr, or nil when nothing should be sent. KoD decisions are treated as
+// drops because these protocols have no way to carry them.
+func (s *LegacyTimeServer) response(addr net.Addr, now time.Time) []byte {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if s.Policy.Decide(ip, now) != PolicyServe {
+		return nil
+	}
+	if !s.Service.Sync.Synchronized(now) {
+		return nil
+	}
+	return s.Format(now)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestLegacyUDPRateLimit checks that without a policy rate limit a burst of
+// UDP Time requests from one address gets only legacyUDPBurst replies.
+func TestLegacyUDPRateLimit(t *testing.T) {
+	ntp := &NTPService{Sync: &SyncState{}}
+	ntp.Sync.Set(SyncUpdate{Source: net.IPv4(192, 0, 2, 1), Stratum: 1}, time.Now())
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s := &LegacyTimeServer{Service: ntp, Policy: &AccessPolicy{}, Format: timeResponse}
+	go s.serveUDP(pc)
+
+	conn, err := net.DialUDP("udp4", nil, pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3*legacyUDPBurst; i++ {
+		if _, err := conn.Write(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replies := 0
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if n != 4 {
+			t.Errorf("reply of %d bytes, want 4", n)
+		}
+		replies++
+	}
+	if replies != legacyUDPBurst {
+		t.Errorf("%d replies to %d requests, want %d", replies, 3*legacyUDPBurst, legacyUDPBurst)
+	}
+}
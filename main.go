@@ -1,57 +1,432 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
 	"fmt"
 	"net"
+	"os"
+	"strings"
+	"time"
 )
 
 const (
 	NtpV4PacketSize = 48 //MS-NTP  && NTP-v3 v4
 	NtpV3PacketSize = 68
+	MaxPacketSize   = 2048 //带扩展字段(NTS cookie等)的报文最大长度
 )
 
 func main() {
+	// 子命令：probe 作为诊断客户端使用
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		os.Exit(runProbe(os.Args[2:], os.Stdout))
+	}
+	keysFile := flag.String("keys", "", "ntp.keys file with symmetric keys (keyid type key)")
+	requireAuth := flag.Bool("require-auth", false, "drop requests that carry no MAC")
+	ntsEnable := flag.Bool("nts", false, "enable Network Time Security (NTS-KE on TCP/4460)")
+	ntsKeAddr := flag.String("nts-ke-addr", fmt.Sprintf(":%d", NtsKePort), "NTS-KE listen address")
+	ntsCert := flag.String("nts-cert", "", "NTS-KE TLS certificate (PEM); empty generates a self-signed one")
+	ntsKey := flag.String("nts-key", "", "NTS-KE TLS private key (PEM)")
+	ntsName := flag.String("nts-name", "localhost", "host name for the self-signed NTS-KE certificate")
+	ntsRotate := flag.Duration("nts-rotate", 24*time.Hour, "NTS cookie master key rotation interval")
+	msSntpKeys := flag.String("mssntp-keys", "", "MS-SNTP machine key file (rid nt-hash [previous-nt-hash])")
+	ignoreNets := flag.String("ignore", "", "comma separated networks whose requests are dropped")
+	denyNets := flag.String("deny", "", "comma separated networks answered with KoD DENY")
+	restrictNets := flag.String("restrict", "", "comma separated networks answered with KoD RSTR")
+	rateInterval := flag.Duration("rate-interval", 0, "average interval allowed between requests per client, 0 disables KoD RATE")
+	rateBurst := flag.Int("rate-burst", 8, "requests a client may send back to back before KoD RATE")
+	leapFile := flag.String("leapfile", "", "IERS leap-seconds.list used to announce leap seconds")
+	smear := flag.Bool("smear", false, "hide leap seconds by smearing instead of setting LI (needs -leapfile)")
+	smearWindow := flag.Duration("smear-window", DefaultSmearWindow, "leap smear window centred on the leap")
+	peers := flag.String("peer", "", "comma separated symmetric active peers (host or host:port)")
+	peerKey := flag.Uint("peer-key", 0, "key ID from -keys used to authenticate peers, 0 for none")
+	peerPoll := flag.Duration("peer-poll", DefaultPeerPoll, "poll interval for symmetric peers")
+	broadcast := flag.String("broadcast", "", fmt.Sprintf("comma separated broadcast addresses or multicast groups to send mode 5 packets to, e.g. 192.168.1.255,%v,[%v]", NtpMulticastIPv4, NtpMulticastIPv6))
+	broadcastInterval := flag.Duration("broadcast-interval", DefaultBroadcastInterval, "interval between broadcast packets")
+	broadcastTTL := flag.Int("broadcast-ttl", DefaultMulticastTTL, "multicast TTL / hop limit")
+	broadcastIface := flag.String("broadcast-iface", "", "interface for sending and joining multicast (broadcast, broadcast client, manycast), empty uses the routing table")
+	broadcastKey := flag.Uint("broadcast-key", 0, "key ID from -keys used to sign broadcast packets, 0 for none")
+	broadcastClient := flag.Bool("broadcast-client", false, "synchronise to mode 5 broadcasts from another server")
+	broadcastGroups := flag.String("broadcast-client-group", "", "comma separated multicast groups to join as broadcast client")
+	broadcastAllow := flag.String("broadcast-client-allow", "", "comma separated networks broadcasts are accepted from, empty accepts any")
+	broadcastClientKey := flag.Uint("broadcast-client-key", 0, "key ID from -keys broadcasts must be signed with, 0 for none")
+	manycastServer := flag.String("manycast-server", "", "comma separated multicast groups to answer manycast requests on, e.g. "+NtpMulticastIPv4.String())
+	manycastClient := flag.String("manycast-client", "", "multicast group to discover servers on")
+	manycastServers := flag.Int("manycast-max", DefaultManycastServers, "servers the manycast client mobilizes")
+	manycastKey := flag.Uint("manycast-key", 0, "key ID from -keys for manycast requests and replies, 0 for none")
+	controlAllow := flag.String("control-allow", "", "comma separated networks allowed to query mode 6 (ntpq), empty allows localhost only")
+	interleaved := flag.Bool("interleaved", false, "support interleaved mode for clients that request it")
+	interleavedClients := flag.Int("interleaved-clients", DefaultInterleavedClients, "clients remembered for interleaved mode")
+	timeAddr := flag.String("time-addr", "", fmt.Sprintf("RFC 868 Time (rdate) listen address for TCP and UDP, e.g. :%d, empty disables", TimePort))
+	daytimeAddr := flag.String("daytime-addr", "", fmt.Sprintf("RFC 867 Daytime listen address for TCP and UDP, e.g. :%d, empty disables", DaytimePort))
+	roughtimeAddr := flag.String("roughtime-addr", "", fmt.Sprintf("Roughtime listen address, e.g. :%d, empty disables", RoughtimePort))
+	roughtimeKey := flag.String("roughtime-key", "", "Roughtime long-term key file (hex Ed25519 seed); empty generates a temporary key")
+	roughtimeRotate := flag.Duration("roughtime-rotate", DefaultRoughtimeRotate, "Roughtime online key rotation interval")
+	httpAddr := flag.String("http-addr", "", fmt.Sprintf("HTTP time listen address, e.g. %s, empty disables", DefaultHTTPTimeAddr))
+	ptpDest := flag.String("ptp", "", fmt.Sprintf("run a PTPv2 master sending to this multicast group or unicast address, e.g. %v, empty disables", PtpMulticastIPv4))
+	ptpListen := flag.String("ptp-listen", "", "local IPv4 address the PTP ports are bound to, empty binds all")
+	ptpDomain := flag.Uint("ptp-domain", 0, "PTP domain number")
+	ptpPriority1 := flag.Uint("ptp-priority1", 128, "PTP grandmaster priority1")
+	ptpPriority2 := flag.Uint("ptp-priority2", 128, "PTP grandmaster priority2")
+	ptpSyncInterval := flag.Duration("ptp-sync-interval", DefaultPtpSyncInterval, "PTP Sync interval, a power of two seconds")
+	configFile := flag.String("config", DefaultConfigFile, "config file with ntpserverip and updatefrequency")
+	verbose := flag.Bool("v", false, "log every dropped request and every time sample")
+	flag.Parse()
+
+	// 读取配置文件，缺少的值在终端上询问，10秒无操作自动继续
+	config, err := LoadServerConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	if isTerminal(os.Stdin) {
+		PromptServerConfig(config, os.Stdin, os.Stdout, DefaultPromptTimeout)
+	}
+
 	// Create a UDP connection
-	var netservice = NTPService{}
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+	var netservice = NTPService{RequireAuth: *requireAuth, Stats: &ServerStats{Started: time.Now()}, Verbose: *verbose}
+	// 配置了上游服务器时，同步前本机时间视为未同步，下游客户端会看到LI=3
+	// 对等体与上游服务器一起参与时钟选择，上游不可达时作为备份；只配置对等体时直接使用本地时钟
+	switch {
+	case config.NtpServerIP != "":
+		poll := config.UpdateFrequency
+		if poll <= 0 {
+			poll = DefaultPeerPoll
+		}
+		netservice.Sync = &SyncState{Holdover: upstreamHoldover * poll}
+	case *manycastClient != "":
+		netservice.Sync = &SyncState{Holdover: upstreamHoldover * *peerPoll}
+	}
+	if *interleaved {
+		netservice.Interleaved = &InterleavedTable{Size: *interleavedClients}
+	}
+	policy := &AccessPolicy{MinInterval: *rateInterval, Burst: *rateBurst}
+	for _, l := range []struct {
+		list string
+		nets *[]*net.IPNet
+	}{{*ignoreNets, &policy.Ignore}, {*denyNets, &policy.Deny}, {*restrictNets, &policy.Restrict}} {
+		nets, err := ParseNetList(l.list)
+		if err != nil {
+			panic(err)
+		}
+		*l.nets = nets
+	}
+	if *keysFile != "" {
+		keys, err := LoadKeyFile(*keysFile)
+		if err != nil {
+			panic(err)
+		}
+		netservice.Keys = keys
+	}
+	if *leapFile != "" {
+		leap, err := LoadLeapSecondsFile(*leapFile)
+		if err != nil {
+			panic(err)
+		}
+		// 长期运行时每天检查一次；过期后文件中已有的闰秒照常发布，但可能缺少新公布的闰秒
+		go func() {
+			for {
+				if leap.Expired(time.Now()) {
+					fmt.Println("WARNING: leap seconds file expired on", leap.Expires.Format("2006-01-02"), "- leap seconds announced since are missing, please update", *leapFile)
+				}
+				time.Sleep(leapFileCheckInterval)
+			}
+		}()
+		netservice.Leap = leap
+		if *smear {
+			netservice.Smear = &LeapSmear{Table: leap, Window: *smearWindow}
+		}
+	}
+	if *msSntpKeys != "" {
+		provider, err := LoadMsSntpKeyFile(*msSntpKeys)
+		if err != nil {
+			panic(err)
+		}
+		netservice.MsSntp = provider
+	}
+	if *ntsEnable {
+		jar, err := NewNtsCookieJar()
+		if err != nil {
+			panic(err)
+		}
+		var cert tls.Certificate
+		if *ntsCert != "" {
+			cert, err = tls.LoadX509KeyPair(*ntsCert, *ntsKey)
+		} else {
+			fmt.Println("NTS-KE using a self-signed certificate for", *ntsName)
+			cert, err = GenerateSelfSignedCert(*ntsName)
+		}
+		if err != nil {
+			panic(err)
+		}
+		netservice.NTS = jar
+		go jar.RotateEvery(*ntsRotate, nil)
+		ke := &NtsKeServer{Addr: *ntsKeAddr, TLS: &tls.Config{Certificates: []tls.Certificate{cert}}, Cookies: jar}
+		go func() {
+			if err := ke.ListenAndServe(); err != nil {
+				fmt.Println("NTS-KE server stopped:", err)
+			}
+		}()
+	}
+	var mcastIface *net.Interface //组播收发接口
+	if *broadcastIface != "" {
+		iface, err := net.InterfaceByName(*broadcastIface)
+		if err != nil {
+			panic(err)
+		}
+		mcastIface = iface
+	}
+	if *broadcast != "" {
+		targets, err := ParseBroadcastTargets(*broadcast)
+		if err != nil {
+			panic(err)
+		}
+		b := &Broadcaster{Service: &netservice, Targets: targets, Interval: *broadcastInterval, TTL: *broadcastTTL, Interface: mcastIface, KeyID: uint32(*broadcastKey)}
+		fmt.Println("Broadcasting to", *broadcast, "every", *broadcastInterval)
+		go func() {
+			if err := b.Run(nil); err != nil {
+				fmt.Println("Broadcaster stopped:", err)
+			}
+		}()
+	}
+	var lc net.ListenConfig
+	if *manycastServer != "" {
+		lc.Control = shareMulticastControl //manycast组播套接字与主套接字共用123端口
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", (&net.UDPAddr{
 		IP: net.IPv4zero,
 		//IP:   net.ParseIP("192.168.16.120"),
 		Port: 123,
-	})
+	}).String())
 	if err != nil {
 		panic(err)
 	}
+	conn := pc.(*net.UDPConn)
 
 	// Close connection
 	defer conn.Close()
 
+	assocs := NewAssociationManager(&netservice, conn)
+	var bclient *BroadcastClient
+	if *broadcastClient {
+		allow, err := ParseNetList(*broadcastAllow)
+		if err != nil {
+			panic(err)
+		}
+		if allow == nil {
+			fmt.Println("WARNING: accepting broadcast time from any address, consider -broadcast-client-allow or -broadcast-client-key")
+		}
+		if *broadcastClientKey != 0 {
+			if _, ok := netservice.Keys.Lookup(uint32(*broadcastClientKey)); !ok {
+				panic(fmt.Errorf("broadcast client: %w %d", ErrUnknownKey, *broadcastClientKey))
+			}
+		}
+		groups, err := ParseMulticastGroups(*broadcastGroups)
+		if err != nil {
+			panic(err)
+		}
+		for _, group := range groups {
+			if err := joinMulticastGroup(conn, group, mcastIface); err != nil {
+				panic(err)
+			}
+			fmt.Println("Joined multicast group", group)
+		}
+		// 在收到广播前本机时间视为未同步，下游客户端会看到LI=3
+		if netservice.Sync == nil {
+			netservice.Sync = &SyncState{Holdover: 8 * DefaultBroadcastInterval}
+		}
+		// 广播服务器与上游服务器、对等体一起参与时钟选择
+		bclient = &BroadcastClient{Service: &netservice, Assocs: assocs, Allow: allow, KeyID: uint32(*broadcastClientKey)}
+	}
+
+	for _, peer := range strings.Split(*peers, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		addr, err := resolveNtpAddr(peer)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := assocs.AddPeer(addr, uint32(*peerKey), *peerPoll); err != nil {
+			panic(err)
+		}
+		fmt.Println("Symmetric active peer", addr)
+	}
+	for _, server := range strings.Split(config.NtpServerIP, ",") {
+		if server = strings.TrimSpace(server); server == "" {
+			continue
+		}
+		addr, err := resolveNtpAddr(server)
+		if err != nil {
+			panic(err)
+		}
+		a, err := assocs.AddServer(addr, 0, config.UpdateFrequency)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("Upstream server", addr, "from", config.Path, "every", a.Poll)
+	}
+	go assocs.Run(nil)
+
+	groups, err := ParseMulticastGroups(*manycastServer)
+	if err != nil {
+		panic(err)
+	}
+	for _, group := range groups {
+		ms := &ManycastServer{Service: &netservice, Policy: policy, Group: &net.UDPAddr{IP: group, Port: 123}, Interface: mcastIface}
+		go func() {
+			if err := ms.Run(); err != nil {
+				fmt.Println("Manycast server stopped:", err)
+			}
+		}()
+	}
+	if *manycastClient != "" {
+		groups, err := ParseMulticastGroups(*manycastClient)
+		if err != nil || len(groups) != 1 {
+			panic(fmt.Errorf("invalid manycast group %q", *manycastClient))
+		}
+		group := groups[0]
+		mc := &ManycastClient{Service: &netservice, Assocs: assocs, Group: &net.UDPAddr{IP: group, Port: 123},
+			TTL: *broadcastTTL, Interface: mcastIface, KeyID: uint32(*manycastKey), Servers: *manycastServers, Poll: *peerPoll}
+		go mc.Run(nil)
+	}
+
+	allow, err := ParseNetList(*controlAllow)
+	if err != nil {
+		panic(err)
+	}
+	control := &ControlServer{Service: &netservice, Assocs: assocs, Allow: allow}
+
+	// RFC 868/867 旧协议与NTP共用时钟和访问策略
+	for _, l := range []struct {
+		addr   string
+		format func(time.Time) []byte
+	}{{*timeAddr, timeResponse}, {*daytimeAddr, daytimeResponse}} {
+		if l.addr == "" {
+			continue
+		}
+		ts := &LegacyTimeServer{Service: &netservice, Policy: policy, Addr: l.addr, Format: l.format}
+		go func() {
+			if err := ts.ListenAndServe(); err != nil {
+				fmt.Println("Time service stopped:", err)
+			}
+		}()
+	}
+
+	if *roughtimeAddr != "" {
+		var key ed25519.PrivateKey
+		if *roughtimeKey != "" {
+			key, err = LoadRoughtimeKey(*roughtimeKey)
+		} else {
+			fmt.Println("Roughtime using a temporary long-term key, clients must be given the new public key after every restart")
+			_, key, err = ed25519.GenerateKey(rand.Reader)
+		}
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("Roughtime public key:", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+		rt := &RoughtimeServer{Service: &netservice, Policy: policy, Addr: *roughtimeAddr, Key: key, Rotate: *roughtimeRotate}
+		go func() {
+			if err := rt.ListenAndServe(); err != nil {
+				fmt.Println("Roughtime server stopped:", err)
+			}
+		}()
+	}
+
+	if *httpAddr != "" {
+		hs := &HTTPTimeServer{Service: &netservice, Policy: policy, Addr: *httpAddr}
+		go func() {
+			if err := hs.ListenAndServe(); err != nil {
+				fmt.Println("HTTP time server stopped:", err)
+			}
+		}()
+	}
+
+	if *ptpDest != "" {
+		ptp := &PTPMaster{Service: &netservice, Policy: policy, Dest: net.ParseIP(*ptpDest), Listen: net.ParseIP(*ptpListen),
+			Interface: mcastIface, TTL: *broadcastTTL, Domain: uint8(*ptpDomain),
+			Priority1: uint8(*ptpPriority1), Priority2: uint8(*ptpPriority2), SyncInterval: *ptpSyncInterval}
+		go func() {
+			if err := ptp.Run(nil); err != nil {
+				fmt.Println("PTP master stopped:", err)
+			}
+		}()
+	}
+
 	fmt.Println("Listening for NTP packets...")
 
 	// Buffer for incoming data
-	buf := make([]byte, NtpV4PacketSize)
+	buf := make([]byte, MaxPacketSize)
 
 	// Wait for incoming packets
 	for {
-		fmt.Println("for内部循环监听中")
 		// Read data from socket
 		n, addr, err := conn.ReadFromUDP(buf)
+		recvTime := netservice.Now() //接收时间戳 ReadFromUDP返回后立即记录
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println(addr)
-		// Check packet size
-		if n != NtpV3PacketSize && n != NtpV4PacketSize {
-			fmt.Println("Invalid packet size")
+		// Mode 6 控制报文头部只有12字节，在长度检查之前交给ntpq接口处理
+		if n > 0 && buf[0]&0x07 == ModeControl {
+			if policy.Decide(addr.IP, recvTime) == PolicyServe {
+				control.HandlePacket(buf[:n], conn, addr, recvTime)
+			}
+			continue
+		}
+		// Check packet size 头部48字节 + 可变长度的扩展字段/MAC，必须按32bit对齐
+		if n < NtpV4PacketSize || n%4 != 0 {
+			netservice.debugln("Invalid packet size", n, "from", addr)
+			continue
+		}
+		// Access policy 访问控制：正常应答、丢弃或回复Kiss-o'-Death
+		decision := policy.Decide(addr.IP, recvTime)
+		if decision == PolicyDrop {
+			continue
+		}
+		if code := decision.KissCode(); code != "" {
+			netservice.SendKissOfDeath(buf[:n], conn, addr, recvTime, code)
+			continue
+		}
+		// Dispatch by mode 对等体报文交给关联管理，其余按客户端请求处理
+		switch buf[0] & 0x07 {
+		case ModeSymmetricActive, ModeSymmetricPassive:
+			assocs.HandlePacket(buf[:n], addr, recvTime)
+			continue
+		case ModeBroadcast:
+			if bclient != nil {
+				bclient.HandlePacket(buf[:n], addr, recvTime)
+			}
+			continue
+		case ModeServer:
+			// 上游服务器的应答交给关联管理；其他服务端报文不应答，避免两台服务器互相反射
+			if assocs.Has(addr) {
+				assocs.HandlePacket(buf[:n], addr, recvTime)
+			}
 			continue
 		}
 		//长度判断完毕进行版本识别
 		// Parse packet--recoginze standNTP or MSNTP
+		if netservice.MsSntp != nil && IsMicrosoftNtpRequest(buf[0:n]) {
+			netservice.HandleMicrosoftNTPServer(buf[:n], conn, addr, recvTime)
+			continue
+		}
 		if IsStandardNtpRequest(buf[0:n]) {
 			//先尝试标准NTP不行MSNTP 再不行抛弃
 			//如果是通用标准NTP服务调用解析服务
-			netservice.HandleStanderNTPServer(buf, conn, addr)
+			netservice.HandleStanderNTPServer(buf[:n], conn, addr, recvTime)
 			continue
 		}
 
 	}
 }
+
+// resolveNtpAddr resolves "host" or "host:port", defaulting to port 123.
+func resolveNtpAddr(hostport string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "123")
+	}
+	return net.ResolveUDPAddr("udp", hostport)
+}